@@ -55,8 +55,8 @@ func TestCodec_Analyse_failure(t *testing.T) {
 }
 
 var goodAnalysesTable = map[ExpectedStructAnalysis]interface{}{
-	{NumChildren: 5, NumFields: 4}:              StructA{},
-	{NumChildren: 5, NumFields: 4, IsPtr: true}: &StructA{},
+	{NumChildren: 7, NumFields: 4}:              StructA{},
+	{NumChildren: 7, NumFields: 4, IsPtr: true}: &StructA{},
 	{NumChildren: 2, NumFields: 1, IsPtr: true}: &StructB{},
 }
 
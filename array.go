@@ -0,0 +1,67 @@
+package hy
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// An ArrayNode represents a fixed size array to be stored in a directory.
+type ArrayNode struct {
+	*DirNodeBase
+}
+
+// NewArrayNode makes a new array node.
+func (c *Codec) NewArrayNode(base NodeBase) (Node, error) {
+	n := &ArrayNode{&DirNodeBase{NodeBase: base}}
+	return n, errors.Wrap(n.AnalyseElemNode(n, c), "analysing array element node")
+}
+
+// ChildPathName returns the array index as a string.
+func (n *ArrayNode) ChildPathName(child Node, key, val reflect.Value) string {
+	return fmt.Sprint(key)
+}
+
+// ReadTargets reads targets into array indicies. Indices with no file are left
+// as zero values, and a file with an index outside the array is an error.
+func (n *ArrayNode) ReadTargets(c ReadContext, key reflect.Value) (reflect.Value, error) {
+	val := reflect.New(n.Type).Elem()
+	indices, names, err := n.indices(c)
+	if err != nil {
+		return val, err
+	}
+	for i, index := range indices {
+		if index >= val.Len() {
+			return val, errors.Errorf("index %d out of range for %s", index, n.Type)
+		}
+		elemKey := reflect.ValueOf(index)
+		elemVal, err := (*n.ElemNode).Read(c.Push(names[i]), elemKey)
+		if err != nil {
+			return val, errors.Wrapf(err, "reading index %d", index)
+		}
+		val.Index(index).Set(n.SetElemKey(elemVal, elemKey))
+	}
+	return val, nil
+}
+
+// WriteTargets writes all the elements of the array.
+func (n *ArrayNode) WriteTargets(c WriteContext, key, val reflect.Value) error {
+	if !val.IsValid() {
+		// A nil pointer to an array has no elements.
+		return nil
+	}
+	elemNode := *n.ElemNode
+	for i := 0; i < val.Len(); i++ {
+		k := reflect.ValueOf(i)
+		v := n.SetElemKey(val.Index(i), k)
+		p := n.indexName(i, val.Len())
+		if err := n.checkElemPath(p); err != nil {
+			return errors.Wrapf(err, "writing array index %d failed", i)
+		}
+		if err := elemNode.Write(c.Push(p), k, v); err != nil {
+			return errors.Wrapf(err, "writing array index %d failed", i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package hy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type ArrayStruct struct {
+	Shards  [4]StructB        `hy:"shards/"`
+	Indexed [2]IndexedElem    `hy:"indexed/,Index"`
+	Nested  [2][2]StructB     `hy:"nested/"`
+	File    [2]string         `hy:"file"`
+	Map     map[string][2]int `hy:"map/"`
+}
+
+func TestArrayNode(t *testing.T) {
+	in := ArrayStruct{
+		Shards:  [4]StructB{{Name: "zero"}, {Name: "one"}, {}, {Name: "three"}},
+		Indexed: [2]IndexedElem{{Index: 0, Name: "zero"}, {Index: 1, Name: "one"}},
+		Nested:  [2][2]StructB{{{Name: "0-0"}}, {{}, {Name: "1-1"}}},
+		File:    [2]string{"a", "b"},
+		Map:     map[string][2]int{"a": {1, 2}},
+	}
+	var out ArrayStruct
+	prefix := roundTrip(t, newTestCodec(), "array", in, &out)
+
+	expectedFiles := map[string]string{
+		"shards/2":   `{"Name":""}`,
+		"shards/3":   `{"Name":"three"}`,
+		"indexed/1":  `{"Name":"one"}`,
+		"nested/1/1": `{"Name":"1-1"}`,
+		"file":       `["a","b"]`,
+		"map/a/1":    `2`,
+	}
+	for path, expected := range expectedFiles {
+		if actual := readTestFile(t, prefix, path); actual != expected {
+			t.Errorf("got %s at %q; want %s", actual, path, expected)
+		}
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got %+v; want %+v", out, in)
+	}
+
+	// Missing indices are read as zero values.
+	if err := os.Remove(filepath.Join(prefix, "shards", "1.json")); err != nil {
+		t.Fatal(err)
+	}
+	out = ArrayStruct{}
+	if err := newTestCodec().Read(prefix, &out); err != nil {
+		t.Fatal(err)
+	}
+	expected := in
+	expected.Shards[1] = StructB{}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("got %+v; want %+v", out, expected)
+	}
+
+	// Indices beyond the end of the array are an error.
+	extra := filepath.Join(prefix, "shards", "4.json")
+	if err := ioutil.WriteFile(extra, []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := newTestCodec().Read(prefix, &ArrayStruct{})
+	if expected := "index 4 out of range for [4]hy.StructB"; err == nil ||
+		!strings.Contains(err.Error(), expected) {
+		t.Errorf("got error %v; want it to contain %q", err, expected)
+	}
+
+	// Names of the same index are an error, rather than one overwriting the
+	// other.
+	if err := os.Rename(extra, filepath.Join(prefix, "shards", "00.json")); err != nil {
+		t.Fatal(err)
+	}
+	err = newTestCodec().Read(prefix, &ArrayStruct{})
+	if expected := `element names "0" and "00" are both index 0`; err == nil ||
+		!strings.Contains(err.Error(), expected) {
+		t.Errorf("got error %v; want it to contain %q", err, expected)
+	}
+}
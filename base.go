@@ -11,11 +11,12 @@ type NodeBase struct {
 	NodeID
 	// Parent is the parent of this node. It is nil only for the root node.
 	Parent Node
-	// FieldInfo is the field info for this node.
+	// FieldInfo is the field info for this node. For map and slice elements it
+	// is the field info of the containing map or slice.
 	Field *FieldInfo
 	// Zero is a zero value of this node's Type.
 	Zero interface{}
-	// HasKey indicates if this type has a key (e.g. maps and slices)
+	// HasKey indicates if this type has a key (e.g. maps, slices and arrays)
 	HasKey bool
 	// self is a pointer to the node based on this node base. This means more
 	// common functionality can be handled by NodeBase, by allowing it to call
@@ -45,25 +46,82 @@ func NewNodeBase(id NodeID, parent Node, field *FieldInfo, self *Node) NodeBase
 		Parent: parent,
 		Field:  field,
 		Zero:   zero,
-		HasKey: k == reflect.Map || k == reflect.Slice,
+		HasKey: k == reflect.Map || k == reflect.Slice || k == reflect.Array,
 		self:   self,
 	}
 }
 
+// Read reads this node's value at c. A pointer, or the inner pointer of a
+// pointer to pointer, is nil if its file contains null.
 func (base NodeBase) Read(c ReadContext, key reflect.Value) (reflect.Value, error) {
+	if base.IsPtr {
+		null, err := isNull(c)
+		if err != nil {
+			return reflect.Value{}, errors.Wrapf(err, "reading node")
+		}
+		if null {
+			if base.IsPtrPtr {
+				return reflect.New(reflect.PtrTo(base.Type)), nil
+			}
+			return reflect.Zero(reflect.PtrTo(base.Type)), nil
+		}
+	}
 	v, err := (*base.self).ReadTargets(c, key)
 	if err != nil {
 		return v, errors.Wrapf(err, "reading node")
 	}
 	if base.IsPtr {
-		v = v.Addr()
+		ptr := reflect.New(base.Type)
+		ptr.Elem().Set(v)
+		v = ptr
+	}
+	if base.IsPtrPtr {
+		ptr := reflect.New(v.Type())
+		ptr.Elem().Set(v)
+		v = ptr
 	}
 	return v, nil
 }
 
+// isNull returns true if the file at c contains null.
+func isNull(c ReadContext) (bool, error) {
+	if !c.IsFile() {
+		return false, nil
+	}
+	var v interface{}
+	err := c.Read(&v)
+	return v == nil, err
+}
+
+// Write writes val at c. Values which are zero, or nil pointers, are not
+// written unless they are elements, which are always written so their keys
+// are kept. A nil pointer element, or the nil inner pointer of a pointer to
+// pointer, is written as null. A pointer to a zero value is written like any
+// other value, so it is read as a pointer to a zero value. A pointer to an
+// empty map or slice stored in a directory is written as an empty file of the
+// directory's own, since the directory would otherwise have no files.
 func (base NodeBase) Write(c WriteContext, key, val reflect.Value) error {
-	if base.IsPtr {
+	if base.IsPtrPtr {
+		if val.IsNil() {
+			return nil
+		}
 		val = val.Elem()
+		if val.IsNil() {
+			return errors.Wrap(c.SetValue(nil), "writing nil pointer")
+		}
+	}
+	if base.IsPtr {
+		if val.IsNil() {
+			if base.HasKey {
+				return errors.Wrap(c.SetValue(nil), "writing nil pointer")
+			}
+			return nil
+		}
+		if isDirCollection(*base.self) && val.Elem().Len() == 0 &&
+			(base.Field == nil || !base.Field.Tag.Entries) {
+			return errors.Wrap(c.SetDirValue(MarkerFile{}), "writing empty directory")
+		}
+		return (*base.self).WriteTargets(c, key, val.Elem())
 	}
 	if !base.HasKey &&
 		(!val.IsValid() || reflect.DeepEqual(val.Interface(), base.Zero)) {
@@ -88,9 +146,12 @@ func (base NodeBase) PathName(key, val reflect.Value) string {
 // If there is no fixed path name, returns empty string and false.
 // Otherwise returns the fixed path name and true.
 func (base NodeBase) FixedPathName() (string, bool) {
-	if base.Field == nil {
+	if base.Field == nil || base.HasKey {
 		return "", false
 	}
+	if base.Field.Tag.Entries {
+		return "", true
+	}
 	if base.Field.PathName != "" {
 		return base.Field.PathName, true
 	}
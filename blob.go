@@ -0,0 +1,152 @@
+package hy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// BlobPointerPrefix begins the content of a pointer file, and is followed by
+// the path of the blob it points to, relative to the prefix.
+const BlobPointerPrefix = "hy-blob:"
+
+// blobPath returns the path of the blob storing b, relative to the prefix.
+func (fm FileMarshaler) blobPath(b []byte) string {
+	return path.Join(fm.BlobDir, fmt.Sprintf("%x", sha256.Sum256(b)))
+}
+
+// writeBlob writes b to its blob, if it does not already exist, and writes
+// the file at p as a symlink or pointer file referring to the blob.
+func (fm FileMarshaler) writeBlob(prefix, p string, b []byte) error {
+	blob := fm.blobPath(b)
+	blobFile := filepath.Join(prefix, blob)
+	if _, err := os.Stat(blobFile); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(blobFile), 0755); err != nil {
+			return errors.Wrapf(err, "creating blob directory")
+		}
+		if err := ioutil.WriteFile(blobFile, b, 0644); err != nil {
+			return errors.Wrapf(err, "writing blob %q", blob)
+		}
+	} else if err != nil {
+		return errors.Wrapf(err, "checking blob %q", blob)
+	}
+	if fm.BlobPointers {
+		return errors.Wrapf(ioutil.WriteFile(p, []byte(BlobPointerPrefix+blob), 0644),
+			"writing pointer file")
+	}
+	target, err := filepath.Rel(filepath.Dir(p), blobFile)
+	if err != nil {
+		return errors.Wrapf(err, "linking to blob %q", blob)
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "replacing file")
+	}
+	return errors.Wrapf(os.Symlink(target, p), "linking to blob %q", blob)
+}
+
+// readBlob returns the content of the blob b points to if b is a pointer
+// file, or b otherwise. A pointer must name a blob in BlobDir by the SHA-256
+// hash of its content, and the content must match the hash.
+func (fm FileMarshaler) readBlob(prefix string, b []byte) ([]byte, error) {
+	if fm.BlobDir == "" || !bytes.HasPrefix(b, []byte(BlobPointerPrefix)) {
+		return b, nil
+	}
+	blob := string(bytes.TrimPrefix(b, []byte(BlobPointerPrefix)))
+	name := path.Base(blob)
+	if !isBlobName(name) || blob != path.Join(fm.BlobDir, name) {
+		return nil, errors.Errorf("pointer to %q is not a blob in %q", blob, fm.BlobDir)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(prefix, blob))
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading blob %q", blob)
+	}
+	if sum := fmt.Sprintf("%x", sha256.Sum256(b)); sum != name {
+		return nil, errors.Errorf("blob %q has content with hash %s", blob, sum)
+	}
+	return b, nil
+}
+
+// isBlobName returns true if name is a hex SHA-256 hash, as blobs are named.
+func isBlobName(name string) bool {
+	if len(name) != sha256.Size*2 {
+		return false
+	}
+	for _, r := range name {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// CollectBlobs removes the blobs in BlobDir within prefix which no file in
+// the tree refers to, by symlink or pointer file, and returns their paths
+// relative to prefix. Files of any extension count as references. It must not
+// run while the tree is being written, since a write stores each blob before
+// the file referring to it, so a blob it has just stored may be removed.
+func (fm FileMarshaler) CollectBlobs(prefix string) ([]string, error) {
+	if fm.BlobDir == "" {
+		return nil, errors.Errorf("no blob directory")
+	}
+	blobDir := filepath.Join(prefix, fm.BlobDir)
+	referenced := map[string]bool{}
+	err := filepath.Walk(prefix, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == blobDir && fi.IsDir() {
+			return filepath.SkipDir
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(p), target)
+			}
+			referenced[filepath.Clean(target)] = true
+			return nil
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if bytes.HasPrefix(b, []byte(BlobPointerPrefix)) {
+			blob := string(bytes.TrimPrefix(b, []byte(BlobPointerPrefix)))
+			referenced[filepath.Join(prefix, blob)] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "finding referenced blobs")
+	}
+	blobs, err := ioutil.ReadDir(blobDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing blobs")
+	}
+	var removed []string
+	for _, fi := range blobs {
+		blobFile := filepath.Join(blobDir, fi.Name())
+		if fi.IsDir() || referenced[blobFile] {
+			continue
+		}
+		if err := os.Remove(blobFile); err != nil {
+			return removed, errors.Wrapf(err, "removing blob %q", fi.Name())
+		}
+		removed = append(removed, path.Join(fm.BlobDir, fi.Name()))
+	}
+	return removed, nil
+}
@@ -0,0 +1,250 @@
+package hy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type BlobStruct struct {
+	Map map[string]StructB `hy:"map/"`
+}
+
+func newBlobCodec(pointers bool) *Codec {
+	return newTestCodec(func(c *Codec) {
+		fm := c.Writer.(FileMarshaler)
+		fm.BlobDir = "_blobs"
+		fm.BlobPointers = pointers
+		c.Writer, c.Reader = fm, fm
+	})
+}
+
+func TestFileMarshaler_blobs(t *testing.T) {
+	in := BlobStruct{
+		Map: map[string]StructB{
+			"a": {Name: "shared"}, "b": {Name: "shared"}, "c": {Name: "other"},
+		},
+	}
+	for name, pointers := range map[string]bool{"blob-links": false, "blob-pointers": true} {
+		c := newBlobCodec(pointers)
+		var out BlobStruct
+		prefix := roundTrip(t, c, name, in, &out)
+
+		if !reflect.DeepEqual(out.Map, in.Map) {
+			t.Errorf("%s: got %+v; want %+v", name, out.Map, in.Map)
+		}
+		a, err := ioutil.ReadFile(filepath.Join(prefix, "map/a.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Lstat(filepath.Join(prefix, "map/a.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isLink := fi.Mode()&os.ModeSymlink != 0; isLink == pointers {
+			t.Errorf("%s: got symlink %t; want %t", name, isLink, !pointers)
+		}
+		if isPointer := strings.HasPrefix(string(a), BlobPointerPrefix); isPointer != pointers {
+			t.Errorf("%s: got pointer file %t; want %t", name, isPointer, pointers)
+		}
+		b, err := ioutil.ReadFile(filepath.Join(prefix, "map/b.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pointers && string(a) != string(b) {
+			t.Errorf("%s: got pointers %q and %q; want the same", name, a, b)
+		}
+
+		// Rewriting a value does not change the blob shared with another.
+		in2 := in
+		in2.Map = map[string]StructB{"a": {Name: "changed"}, "b": {Name: "shared"}}
+		if err := c.Write(prefix, in2); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(filepath.Join(prefix, "map/c.json")); err != nil {
+			t.Fatal(err)
+		}
+		out = BlobStruct{}
+		if err := c.Read(prefix, &out); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(out.Map, in2.Map) {
+			t.Errorf("%s: got %+v; want %+v", name, out.Map, in2.Map)
+		}
+
+		// Only the blob of "other" is unreferenced.
+		removed, err := c.Writer.(FileMarshaler).CollectBlobs(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(removed) != 1 || !strings.HasPrefix(removed[0], "_blobs/") {
+			t.Errorf("%s: got removed %q; want 1 blob", name, removed)
+		}
+		out = BlobStruct{}
+		if err := c.Read(prefix, &out); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(out.Map, in2.Map) {
+			t.Errorf("%s: got %+v after collecting blobs; want %+v", name, out.Map, in2.Map)
+		}
+	}
+}
+
+type BlobNestedStruct struct {
+	Nested map[string]map[string]StructB `hy:"nested/"`
+	Slice  []StructB                     `hy:"slice/"`
+	Split  map[string]*SplitService      `hy:"svc/"`
+}
+
+func TestFileMarshaler_collectBlobs_nested(t *testing.T) {
+	for name, pointers := range map[string]bool{"blob-nested-links": false, "blob-nested-pointers": true} {
+		c := newBlobCodec(pointers)
+		in := BlobNestedStruct{
+			Nested: map[string]map[string]StructB{"eu": {"api": {Name: "eu api"}}},
+			Slice:  []StructB{{Name: "first"}},
+			Split: map[string]*SplitService{
+				"api": {Config: StructB{Name: "config"}, Secrets: &StructB{Name: "secrets"}},
+			},
+		}
+		var out BlobNestedStruct
+		prefix := roundTrip(t, c, name, in, &out)
+
+		// A file of another extension referring to a blob keeps it too.
+		fm := c.Writer.(FileMarshaler)
+		kept := fm.blobPath([]byte("kept"))
+		if err := ioutil.WriteFile(filepath.Join(prefix, kept), []byte("kept"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(prefix, "notes.txt"),
+			[]byte(BlobPointerPrefix+kept), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		removed, err := fm.CollectBlobs(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(removed) != 0 {
+			t.Errorf("%s: got removed %q; want none", name, removed)
+		}
+		out = BlobNestedStruct{}
+		if err := c.Read(prefix, &out); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(out, in) {
+			t.Errorf("%s: got %+v after collecting blobs; want %+v", name, out, in)
+		}
+	}
+}
+
+func TestFileMarshaler_blobs_failure(t *testing.T) {
+	c := newBlobCodec(true)
+	in := BlobStruct{Map: map[string]StructB{"a": {Name: "a"}}}
+	prefix := roundTrip(t, c, "blob-pointers-failure", in, &BlobStruct{})
+	if err := ioutil.WriteFile(filepath.Join(prefix, "secret"), []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	other := c.Writer.(FileMarshaler).blobPath([]byte(`{"Name":"y"}`))
+	if err := ioutil.WriteFile(filepath.Join(prefix, other), []byte(`{"Name":"x"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for pointer, expected := range map[string]string{
+		"../secret":                         `pointer to "../secret" is not a blob in "_blobs"`,
+		"_blobs/../secret":                  `pointer to "_blobs/../secret" is not a blob in "_blobs"`,
+		"_blobs/" + strings.Repeat("0", 64): "reading blob",
+		other:                               "has content with hash",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(prefix, "map/a.json"),
+			[]byte(BlobPointerPrefix+pointer), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := c.Read(prefix, &BlobStruct{})
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("got error %v for pointer %q; want it to contain %q", err, pointer, expected)
+		}
+	}
+}
+
+func TestFileMarshaler_linkShared(t *testing.T) {
+	c := newTestCodec(func(c *Codec) {
+		fm := c.Writer.(FileMarshaler)
+		fm.LinkShared = true
+		c.Writer = fm
+	})
+	in := BlobStruct{
+		Map: map[string]StructB{
+			"a": {Name: "shared"}, "b": {Name: "shared"}, "c": {Name: "other"},
+		},
+	}
+	var out BlobStruct
+	prefix := roundTrip(t, c, "link-shared", in, &out)
+
+	for link, expected := range map[string]string{"map/b.json": "a.json", "map/a.json": "", "map/c.json": ""} {
+		actual, err := os.Readlink(filepath.Join(prefix, link))
+		if expected == "" {
+			if err == nil {
+				t.Errorf("got symlink to %q at %q; want regular file", actual, link)
+			}
+			continue
+		}
+		if err != nil || actual != expected {
+			t.Errorf("got symlink to %q (%v) at %q; want %q", actual, err, link, expected)
+		}
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got %+v; want %+v", out, in)
+	}
+
+	// Rewriting the canonical file replaces its links.
+	in.Map["a"] = StructB{Name: "changed"}
+	if err := c.Write(prefix, in); err != nil {
+		t.Fatal(err)
+	}
+	out = BlobStruct{}
+	if err := c.Read(prefix, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got %+v; want %+v", out, in)
+	}
+}
+
+func TestFileMarshaler_symlinkPolicies(t *testing.T) {
+	in := BlobStruct{
+		Map: map[string]StructB{"a": {Name: "shared"}, "b": {Name: "shared"}},
+	}
+	for _, policy := range []string{SymlinksIgnore, SymlinksError} {
+		for name, configure := range map[string]func(*FileMarshaler){
+			"link-shared": func(fm *FileMarshaler) { fm.LinkShared = true },
+			"blob-links":  func(fm *FileMarshaler) { fm.BlobDir = "_blobs" },
+		} {
+			c := newTestCodec(func(c *Codec) {
+				fm := c.Writer.(FileMarshaler)
+				configure(&fm)
+				c.Writer, c.Reader = fm, fm
+				c.TreeReader.Symlinks = policy
+				c.TreeReader.BlobDir, c.TreeReader.LinkShared = fm.BlobDir, fm.LinkShared
+			})
+			var out BlobStruct
+			prefix := roundTrip(t, c, name+"-"+policy, in, &out)
+			if !reflect.DeepEqual(out, in) {
+				t.Errorf("%s with policy %q: got %+v; want %+v", name, policy, out, in)
+			}
+
+			// Without the tree reader options, the policy applies to them too.
+			c.TreeReader.BlobDir, c.TreeReader.LinkShared = "", false
+			out = BlobStruct{}
+			err := c.Read(prefix, &out)
+			if policy == SymlinksError {
+				if expected := "not allowed"; err == nil || !strings.Contains(err.Error(), expected) {
+					t.Errorf("%s: got error %v; want it to contain %q", name, err, expected)
+				}
+			} else if err != nil || reflect.DeepEqual(out, in) {
+				t.Errorf("%s with policy %q: got %+v, error %v; want links skipped", name, policy, out, err)
+			}
+		}
+	}
+}
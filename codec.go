@@ -1,7 +1,10 @@
 package hy
 
 import (
+	"fmt"
+	"path"
 	"reflect"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -12,6 +15,32 @@ type Codec struct {
 	Writer     FileWriter
 	Reader     FileReader
 	TreeReader *FileTreeReader
+	// PathNames is the naming convention for paths of fields whose tag does
+	// not name the path, e.g. `hy:"."` or `hy:"/"`. If nil, the field name is
+	// used unchanged.
+	PathNames NamingConvention
+	// FieldNames is the naming convention for fields stored in struct files
+	// which are not named by a json tag. If nil, the field name is used
+	// unchanged.
+	FieldNames NamingConvention
+	// RootTag is the hy tag applied to map and slice roots. It defaults to
+	// "/", storing each element in its own file in the root directory. Use
+	// "." to store a map or slice root in a single root file.
+	RootTag string
+	// TypeField is the name of the field in struct files storing the
+	// registered name of the concrete type of an interface field or element,
+	// unless it is tagged with the typesuffix option. It defaults to "type".
+	TypeField string
+	// SpillSize is the size in bytes of JSON above which the value of an
+	// inline field is written to its own file, rather than its struct's file.
+	// If zero, values are never spilled. Spill files are not removed when
+	// values shrink back into their struct's file, but are then ignored.
+	SpillSize int
+	// SpillField is the name of the field in struct files listing the names
+	// of fields spilled to their own files. It defaults to "spilled".
+	SpillField string
+	// types maps registered names to concrete types.
+	types map[string]reflect.Type
 }
 
 // NewCodec creates a new codec.
@@ -23,9 +52,50 @@ func NewCodec(configure ...func(*Codec)) *Codec {
 	if c.Writer == nil {
 		c.Writer = JSONWriter
 	}
+	if c.RootTag == "" {
+		c.RootTag = "/"
+	}
+	if c.TypeField == "" {
+		c.TypeField = "type"
+	}
+	if c.SpillField == "" {
+		c.SpillField = "spilled"
+	}
 	return c
 }
 
+// RegisterType registers the concrete type of v with name, so that interface
+// fields and elements holding values of that type can be written and read.
+// Types must be registered before the first Analyse, Read or Write, since
+// analysed nodes are kept and would not know of types registered later. Names
+// must be valid path segments not containing ".", so they can be used as file
+// name suffixes.
+func (c *Codec) RegisterType(name string, v interface{}) error {
+	if c.nodes.Len() != 0 {
+		return errors.Errorf("cannot register type %q after analysis", name)
+	}
+	if !isPathSegment(name) || strings.Contains(name, ".") {
+		return errors.Errorf("type name %q invalid", name)
+	}
+	if v == nil {
+		return errors.Errorf("cannot register nil as %q", name)
+	}
+	t := reflect.TypeOf(v)
+	if c.types == nil {
+		c.types = map[string]reflect.Type{}
+	}
+	for otherName, other := range c.types {
+		if otherName == name {
+			return errors.Errorf("type name %q already registered for %s", name, other)
+		}
+		if other == t {
+			return errors.Errorf("type %s already registered as %q", t, otherName)
+		}
+	}
+	c.types[name] = t
+	return nil
+}
+
 func (c *Codec) Read(prefix string, root interface{}) error {
 	rootNode, err := c.Analyse(root)
 	if err != nil {
@@ -54,6 +124,16 @@ func (c *Codec) Write(prefix string, root interface{}) error {
 	if err := rootNode.Write(wc, reflect.Value{}, v); err != nil {
 		return errors.Wrapf(err, "generating write targets")
 	}
+	if err := c.checkTargetPaths(wc.targets); err != nil {
+		return err
+	}
+	if w, ok := c.Writer.(FileSetWriter); ok {
+		targets := make([]WriteTarget, 0, wc.targets.Len())
+		for _, t := range wc.targets.Snapshot() {
+			targets = append(targets, t)
+		}
+		return errors.Wrapf(w.WriteFiles(prefix, targets), "writing targets")
+	}
 	for _, t := range wc.targets.Snapshot() {
 		if err := c.Writer.WriteFile(prefix, t); err != nil {
 			return errors.Wrapf(err, "writing target %q", t.Path())
@@ -62,6 +142,28 @@ func (c *Codec) Write(prefix string, root interface{}) error {
 	return nil
 }
 
+// checkTargetPaths returns an error if any of targets other than a directory's
+// own file is named like one, e.g. the element of a map with key "_", since it
+// would be read back as its directory's own file.
+func (c *Codec) checkTargetPaths(targets FileTargets) error {
+	rootFileName := ""
+	if fm, ok := c.Writer.(FileMarshaler); ok {
+		rootFileName = fm.RootFileName
+	} else if c.TreeReader != nil {
+		rootFileName = c.TreeReader.RootFileName
+	}
+	if rootFileName == "" {
+		return nil
+	}
+	for p := range targets.Snapshot() {
+		if p != "" && !strings.HasSuffix(p, "/") && path.Base(p) == rootFileName {
+			return errors.Errorf("path %q is reserved for the file of directory %q",
+				p, path.Dir(p))
+		}
+	}
+	return nil
+}
+
 // Analyse analyses a tree starting at root.
 func (c *Codec) Analyse(root interface{}) (Node, error) {
 	if root == nil {
@@ -72,17 +174,41 @@ func (c *Codec) Analyse(root interface{}) (Node, error) {
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to analyse %T", root)
 	}
+	if id.IsPtrPtr {
+		return nil, errors.Errorf("failed to analyse %T: cannot analyse pointer to pointer", root)
+	}
+	if id.Type.Kind() == reflect.Interface {
+		// The concrete type of an interface root is unknown.
+		return nil, errors.Errorf("failed to analyse %T: cannot analyse kind interface", root)
+	}
 	if id.IsLeaf {
 		return nil, errors.Errorf("failed to analyse %s: cannot analyse kind %s",
 			id.Type, id.Type.Kind())
 	}
-	n, err := c.NewNode(nil, id, nil)
+	var field *FieldInfo
+	if k := id.Type.Kind(); k == reflect.Map || k == reflect.Slice || k == reflect.Array {
+		field, err = c.rootFieldInfo(id.Type)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to analyse %T", root)
+		}
+	}
+	n, err := c.NewNode(nil, id, field)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to analyse %T", root)
 	}
 	return *n, err
 }
 
+// rootFieldInfo returns field info for a map or slice root of type t, as if it
+// were a field tagged with RootTag.
+func (c *Codec) rootFieldInfo(t reflect.Type) (*FieldInfo, error) {
+	return NewFieldInfo(reflect.StructField{
+		Name: "root",
+		Type: t,
+		Tag:  reflect.StructTag(fmt.Sprintf(`hy:%q`, c.RootTag)),
+	})
+}
+
 // NewNode creates a new node.
 func (c *Codec) NewNode(parent Node, id NodeID, field *FieldInfo) (*Node, error) {
 	n, new := c.nodes.Register(id)
@@ -96,7 +222,34 @@ func (c *Codec) NewNode(parent Node, id NodeID, field *FieldInfo) (*Node, error)
 		*n, err = c.NewStructNode(base)
 		return n, err
 	}
-	if id.IsLeaf || !field.Tag.IsDir {
+	if k == reflect.Interface {
+		*n, err = c.NewInterfaceNode(base)
+		return n, errors.Wrapf(err, "analysing %s failed", id)
+	}
+	if field != nil && field.Tag.Marker && !base.HasKey {
+		// Bool fields are markers themselves, and maps are sets of markers.
+		if k == reflect.Bool && !id.IsPtr {
+			*n = NewMarkerNode(base)
+			return n, nil
+		}
+		if k != reflect.Map || !field.Tag.IsDir {
+			return n, errors.Errorf("analysing %s failed: marker needs a bool or a map stored in a directory", id)
+		}
+	}
+	if base.HasKey && !id.IsLeaf {
+		// Elements which are maps or slices are stored in directories nested
+		// in their parent's directory, up to the depth set by its tag.
+		if elemField := field.ElemDirFieldInfo(id.Type); elemField != nil {
+			field = elemField
+			base.Field = field
+		} else {
+			field = nil
+		}
+	}
+	if id.IsLeaf || field == nil || !field.Tag.IsDir {
+		if base.HasKey && base.Field.Tag.ElemDirs {
+			return n, errors.Errorf("analysing %s failed: elemdirs needs struct elements", id)
+		}
 		*n = NewFileNode(base)
 		return n, nil
 	}
@@ -107,6 +260,8 @@ func (c *Codec) NewNode(parent Node, id NodeID, field *FieldInfo) (*Node, error)
 		*n, err = c.NewMapNode(base)
 	case reflect.Slice:
 		*n, err = c.NewSliceNode(base)
+	case reflect.Array:
+		*n, err = c.NewArrayNode(base)
 	}
 	return n, errors.Wrapf(err, "analysing %s failed", id)
 }
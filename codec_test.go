@@ -3,6 +3,7 @@ package hy
 import (
 	"encoding/json"
 	"os"
+	"reflect"
 	"sync/atomic"
 	"testing"
 )
@@ -40,3 +41,53 @@ func TestCodec_Write(t *testing.T) {
 		t.Errorf("MarshalFunc called %d times; want %d", *numCalls, expectedNumCalls)
 	}
 }
+
+func TestCodec_mapAndSliceRoots(t *testing.T) {
+	c := newTestCodec()
+
+	inMap := map[string]StructB{"api": {Name: "api"}, "web": {Name: "web"}}
+	var outMap map[string]StructB
+	prefix := roundTrip(t, c, "root-map", inMap, &outMap)
+	if actual := readTestFile(t, prefix, "api"); actual != `{"Name":"api"}` {
+		t.Errorf("got %s; want %s", actual, `{"Name":"api"}`)
+	}
+	if !reflect.DeepEqual(outMap, inMap) {
+		t.Errorf("got %+v; want %+v", outMap, inMap)
+	}
+
+	inSlice := []*StructB{{Name: "zero"}, {Name: "one"}}
+	var outSlice []*StructB
+	prefix = roundTrip(t, c, "root-slice", &inSlice, &outSlice)
+	if actual := readTestFile(t, prefix, "1"); actual != `{"Name":"one"}` {
+		t.Errorf("got %s; want %s", actual, `{"Name":"one"}`)
+	}
+	if !reflect.DeepEqual(outSlice, inSlice) {
+		t.Errorf("got %+v; want %+v", outSlice, inSlice)
+	}
+}
+
+func TestCodec_mapAndSliceRoots_rootTag(t *testing.T) {
+	inMap := map[string]StructB{"api": {}, "web": {}}
+
+	c := newTestCodec(func(c *Codec) { c.RootTag = "/,Name" })
+	var outMap map[string]StructB
+	prefix := roundTrip(t, c, "root-map-key", inMap, &outMap)
+	if actual := readTestFile(t, prefix, "api"); actual != `{}` {
+		t.Errorf("got %s; want %s", actual, `{}`)
+	}
+	expected := map[string]StructB{"api": {Name: "api"}, "web": {Name: "web"}}
+	if !reflect.DeepEqual(outMap, expected) {
+		t.Errorf("got %+v; want %+v", outMap, expected)
+	}
+
+	c = newTestCodec(func(c *Codec) { c.RootTag = "." })
+	outMap = nil
+	prefix = roundTrip(t, c, "root-map-file", inMap, &outMap)
+	expectedFile := `{"api":{"DirSubMap":null,"FileSubStruct":null,"Name":""},"web":{"DirSubMap":null,"FileSubStruct":null,"Name":""}}`
+	if actual := readTestFile(t, prefix, "_"); actual != expectedFile {
+		t.Errorf("got %s; want %s", actual, expectedFile)
+	}
+	if !reflect.DeepEqual(outMap, inMap) {
+		t.Errorf("got %+v; want %+v", outMap, inMap)
+	}
+}
@@ -1,20 +1,140 @@
 package hy
 
-import "github.com/pkg/errors"
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
 
 // A DirNodeBase is the base type for a node stored in a directory.
 type DirNodeBase struct {
 	NodeBase
 	ElemNode *Node
+	// Exclude is the set of names in this node's directory which are not
+	// elements. It is only set for entries of a struct, where it contains
+	// the path names of the struct's other children.
+	Exclude map[string]bool
 }
 
 // AnalyseElemNode sets the element node for this directory-bound node.
 func (n *DirNodeBase) AnalyseElemNode(parent Node, c *Codec) error {
-	elemType := n.Type.Elem()
+	return n.analyseElemNode(parent, c, n.Type.Elem())
+}
+
+// analyseElemNode sets the element node for this directory-bound node, whose
+// elements are stored as values of elemType.
+func (n *DirNodeBase) analyseElemNode(parent Node, c *Codec, elemType reflect.Type) error {
 	elemID, err := NewNodeID(n.Type, elemType, "")
 	if err != nil {
 		return errors.Wrap(err, "getting node ID")
 	}
-	n.ElemNode, err = c.NewNode(parent, elemID, nil)
+	if elemID.IsPtrPtr {
+		return errors.Errorf("element type %s not supported; must not be pointer to pointer", elemType)
+	}
+	if n.Field != nil {
+		elemID.Tag = n.Field.Tag
+	}
+	n.ElemNode, err = c.NewNode(parent, elemID, n.Field)
 	return errors.Wrapf(err, "analysing type %T failed", elemType)
 }
+
+// isDirCollection returns true if n is a map, slice or array stored in a
+// directory.
+func isDirCollection(n Node) bool {
+	switch n.(type) {
+	case *MapNode, *SliceNode, *ArrayNode:
+		return true
+	}
+	return false
+}
+
+// SetElemKey returns an addressable copy of elem with its key set to key by
+// this node's field's SetKeyFunc, if it has one.
+func (n *DirNodeBase) SetElemKey(elem, key reflect.Value) reflect.Value {
+	v := reflect.New(elem.Type()).Elem()
+	v.Set(elem)
+	if n.Field == nil || !n.Field.SetKeyFunc.IsValid() {
+		return v
+	}
+	vAddr := v
+	if vAddr.Kind() != reflect.Ptr {
+		vAddr = v.Addr()
+	}
+	n.Field.SetKeyFunc.Call([]reflect.Value{vAddr, key})
+	return v
+}
+
+// indexName returns the path name of index i of a slice or array of length n,
+// zero-padded to the width of the largest index if the field is tagged with
+// the pad option.
+func (n *DirNodeBase) indexName(i, length int) string {
+	if n.Field == nil || !n.Field.Tag.PadIndices {
+		return strconv.Itoa(i)
+	}
+	width := len(strconv.Itoa(length - 1))
+	return fmt.Sprintf("%0*d", width, i)
+}
+
+// indices returns the indices of the elements in the directory of c in
+// ascending order, and their names.
+func (n *DirNodeBase) indices(c ReadContext) ([]int, []string, error) {
+	list := n.List(c)
+	byIndex := make(map[int]string, len(list))
+	indices := make([]int, 0, len(list))
+	for _, name := range list {
+		index, err := strconv.Atoi(name)
+		if err != nil {
+			return nil, nil, errors.Errorf("element name %q is not an index", name)
+		}
+		if index < 0 {
+			return nil, nil, errors.Errorf("element name %q is a negative index", name)
+		}
+		if other, ok := byIndex[index]; ok {
+			return nil, nil, errors.Errorf("element names %q and %q are both index %d",
+				other, name, index)
+		}
+		byIndex[index] = name
+		indices = append(indices, index)
+	}
+	sort.Ints(indices)
+	names := make([]string, len(indices))
+	for i, index := range indices {
+		names[i] = byIndex[index]
+	}
+	return indices, names, nil
+}
+
+// List lists the names of elements in the directory of c.
+func (n *DirNodeBase) List(c ReadContext) []string {
+	return n.exclude(trimTypeSuffixes(*n.ElemNode, c.List()))
+}
+
+// exclude returns list without the names in Exclude.
+func (n *DirNodeBase) exclude(list []string) []string {
+	if len(n.Exclude) == 0 {
+		return list
+	}
+	elems := list[:0]
+	for _, name := range list {
+		if !n.Exclude[name] {
+			elems = append(elems, name)
+		}
+	}
+	return elems
+}
+
+// checkElemPath returns an error if the element path p collides with a name
+// in Exclude.
+func (n *DirNodeBase) checkElemPath(p string) error {
+	if i := strings.Index(p, "/"); i != -1 {
+		p = p[:i]
+	}
+	if n.Exclude[p] {
+		return errors.Errorf("element path %q collides with another field", p)
+	}
+	return nil
+}
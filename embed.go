@@ -0,0 +1,125 @@
+package hy
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// structFields returns the fields of struct type t, including the fields of
+// embedded structs, which are promoted as they are by Go. A field shadows any
+// fields with the same name at a greater depth, and fields with the same name
+// at the same depth shadow each other, so none of them are returned. The Index
+// of each returned field is its index sequence in t, for use with
+// reflect.Value.FieldByIndex. Unexported fields are not returned.
+func structFields(t reflect.Type) ([]reflect.StructField, error) {
+	type embedded struct {
+		t     reflect.Type
+		index []int
+	}
+	var fields []reflect.StructField
+	// shadowed are the names of fields at shallower depths.
+	shadowed := map[string]bool{}
+	visited := map[reflect.Type]bool{}
+	for current := []embedded{{t: t}}; len(current) != 0; {
+		var next []embedded
+		var candidates []reflect.StructField
+		count := map[string]int{}
+		for _, e := range current {
+			if visited[e.t] {
+				// A type embedded at a shallower depth, whose fields are
+				// all shadowed.
+				continue
+			}
+			for i := 0; i < e.t.NumField(); i++ {
+				sf := e.t.Field(i)
+				sf.Index = append(append([]int(nil), e.index...), i)
+				count[sf.Name]++
+				if isFlattened(sf) {
+					if sf.Type.Kind() == reflect.Ptr && sf.PkgPath != "" {
+						return nil, errors.Errorf("embedded field %s.%s is a pointer to unexported type %s",
+							e.t, sf.Name, sf.Type.Elem())
+					}
+					next = append(next, embedded{t: removePointer(sf.Type), index: sf.Index})
+					continue
+				}
+				if sf.PkgPath != "" && !sf.Anonymous {
+					continue
+				}
+				candidates = append(candidates, sf)
+			}
+		}
+		for _, e := range current {
+			visited[e.t] = true
+		}
+		for _, sf := range candidates {
+			if !shadowed[sf.Name] && count[sf.Name] == 1 {
+				fields = append(fields, sf)
+			}
+		}
+		for name := range count {
+			shadowed[name] = true
+		}
+		current = next
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return indexLess(fields[i].Index, fields[j].Index)
+	})
+	return fields, nil
+}
+
+// isFlattened returns true if sf is an embedded struct, or pointer to struct,
+// whose fields are promoted into the struct embedding it. As with
+// encoding/json, embedded structs given a name by a tag are not flattened.
+func isFlattened(sf reflect.StructField) bool {
+	if !sf.Anonymous || removePointer(sf.Type).Kind() != reflect.Struct {
+		return false
+	}
+	if _, ok := sf.Tag.Lookup("hy"); ok {
+		return false
+	}
+	jsonTag := ParseJSONTag(sf)
+	return jsonTag.Name == "" && !jsonTag.Ignore
+}
+
+// indexLess returns true if index sequence a comes before b in declaration
+// order.
+func indexLess(a, b []int) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// fieldByIndex returns the field of struct val at index. It returns an invalid
+// value if the field is promoted through a nil embedded pointer.
+func fieldByIndex(val reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i != 0 && val.Kind() == reflect.Ptr {
+			if val.IsNil() {
+				return reflect.Value{}
+			}
+			val = val.Elem()
+		}
+		val = val.Field(x)
+	}
+	return val
+}
+
+// setFieldByIndex returns the settable field of struct val at index,
+// allocating any nil embedded pointers it is promoted through.
+func setFieldByIndex(val reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i != 0 && val.Kind() == reflect.Ptr {
+			if val.IsNil() {
+				val.Set(reflect.New(val.Type().Elem()))
+			}
+			val = val.Elem()
+		}
+		val = val.Field(x)
+	}
+	return val
+}
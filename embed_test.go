@@ -0,0 +1,175 @@
+package hy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type (
+	EmbedCommon struct {
+		ID     string
+		Owner  string
+		Shared StructB `hy:"shared"`
+	}
+	EmbedExtra struct {
+		Notes string
+		Owner string
+		Extra StructB `hy:"extra"`
+	}
+	EmbedOuter struct {
+		EmbedCommon
+		*EmbedExtra
+		Name string
+		// ID shadows EmbedCommon.ID.
+		ID string `json:"id"`
+	}
+	EmbedNilPtr struct {
+		*EmbedExtra
+		Name string
+	}
+	EmbedElem struct {
+		EmbedCommon
+		Count int
+	}
+	EmbedElems struct {
+		Elems map[string]EmbedElem `hy:"elems/,ID"`
+	}
+	EmbedTagged struct {
+		EmbedCommon `hy:"common"`
+		Name        string
+	}
+)
+
+func TestStructNode_embedded(t *testing.T) {
+	in := EmbedOuter{
+		EmbedCommon: EmbedCommon{
+			ID:     "common id",
+			Owner:  "ambiguous",
+			Shared: StructB{Name: "shared"},
+		},
+		EmbedExtra: &EmbedExtra{
+			Notes: "notes",
+			Owner: "ambiguous",
+			Extra: StructB{Name: "extra"},
+		},
+		Name: "outer",
+		ID:   "outer id",
+	}
+	var out EmbedOuter
+	prefix := roundTrip(t, newTestCodec(), "embedded", in, &out)
+
+	// Owner is at the same depth in both embedded structs, so neither is
+	// promoted, and EmbedCommon.ID is shadowed by EmbedOuter.ID.
+	expectedFiles := map[string]string{
+		"_":      `{"Name":"outer","Notes":"notes","id":"outer id"}`,
+		"shared": `{"Name":"shared"}`,
+		"extra":  `{"Name":"extra"}`,
+	}
+	for path, expected := range expectedFiles {
+		if actual := readTestFile(t, prefix, path); actual != expected {
+			t.Errorf("got %s at %q; want %s", actual, path, expected)
+		}
+	}
+	expected := in
+	expected.EmbedCommon.ID = ""
+	expected.EmbedCommon.Owner = ""
+	expected.EmbedExtra = &EmbedExtra{Notes: "notes", Extra: StructB{Name: "extra"}}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("got %+v; want %+v", out, expected)
+	}
+}
+
+func TestStructNode_embedded_nilPtr(t *testing.T) {
+	in := EmbedNilPtr{Name: "outer"}
+	var out EmbedNilPtr
+	prefix := roundTrip(t, newTestCodec(), "embedded-nil-ptr", in, &out)
+
+	if actual, expected := readTestFile(t, prefix, "_"), `{"Name":"outer"}`; actual != expected {
+		t.Errorf("got %s; want %s", actual, expected)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got %+v; want %+v", out, in)
+	}
+}
+
+func TestStructNode_embedded_renamed(t *testing.T) {
+	in := EmbedNilPtr{Name: "outer"}
+	var out EmbedNilPtr
+	c := newTestCodec(func(c *Codec) { c.FieldNames = SnakeCase })
+	prefix := roundTrip(t, c, "embedded-renamed", in, &out)
+
+	if actual, expected := readTestFile(t, prefix, "_"), `{"name":"outer"}`; actual != expected {
+		t.Errorf("got %s; want %s", actual, expected)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got %+v; want %+v", out, in)
+	}
+}
+
+func TestStructNode_embedded_keyField(t *testing.T) {
+	in := EmbedElems{
+		Elems: map[string]EmbedElem{
+			"a": {EmbedCommon: EmbedCommon{ID: "a", Owner: "me"}, Count: 1},
+		},
+	}
+	var out EmbedElems
+	prefix := roundTrip(t, newTestCodec(), "embedded-key-field", in, &out)
+
+	if actual, expected := readTestFile(t, prefix, "elems/a"), `{"Count":1,"Owner":"me"}`; actual != expected {
+		t.Errorf("got %s; want %s", actual, expected)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got %+v; want %+v", out, in)
+	}
+}
+
+func TestStructNode_embedded_tagged(t *testing.T) {
+	in := EmbedTagged{
+		EmbedCommon: EmbedCommon{ID: "id", Shared: StructB{Name: "shared"}},
+		Name:        "outer",
+	}
+	var out EmbedTagged
+	prefix := roundTrip(t, newTestCodec(), "embedded-tagged", in, &out)
+
+	expectedFiles := map[string]string{
+		"_":             `{"Name":"outer"}`,
+		"common":        `{"ID":"id","Owner":""}`,
+		"common/shared": `{"Name":"shared"}`,
+	}
+	for path, expected := range expectedFiles {
+		if actual := readTestFile(t, prefix, path); actual != expected {
+			t.Errorf("got %s at %q; want %s", actual, path, expected)
+		}
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got %+v; want %+v", out, in)
+	}
+}
+
+func TestStructNode_embedded_failure(t *testing.T) {
+	type (
+		embedUnexported struct{ Name string }
+		unexportedPtr   struct {
+			*embedUnexported
+		}
+		pathCollision struct {
+			EmbedCommon
+			Other StructB `hy:"shared"`
+		}
+	)
+	c := NewCodec()
+	for expected, input := range map[string]interface{}{
+		"is a pointer to unexported type": unexportedPtr{},
+		`both have path name "shared"`:    pathCollision{},
+	} {
+		_, err := c.Analyse(input)
+		if err == nil {
+			t.Errorf("got nil error for %T; want error containing %q", input, expected)
+			continue
+		}
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("got error %q for %T; want it to contain %q", err, input, expected)
+		}
+	}
+}
@@ -14,12 +14,12 @@ type FieldInfo struct {
 	Name, FieldName, PathName, KeyField, GetKeyName, SetKeyName string
 	// Type is the type of this fields.
 	Type,
-	// KeyType is nil unless this field is a map or slice. If this field is a
-	// map, then KeyType will be the type of the map's key. If it's a slice,
-	// then KeyType will be int.
+	// KeyType is nil unless this field is a map, slice or array. If this
+	// field is a map, then KeyType will be the type of the map's key. If it's
+	// a slice or array, then KeyType will be int.
 	KeyType,
-	// ElemType is nil unless this field is a map or slice. It is the element
-	// type of the map or slice.
+	// ElemType is nil unless this field is a map, slice or array. It is the
+	// element type of the map, slice or array.
 	ElemType reflect.Type
 	// GetKeyFunc is a function getting the key from this map or slice's element.
 	GetKeyFunc,
@@ -42,6 +42,10 @@ type FieldInfo struct {
 	// AutoPathName indicates the file or directory storing this field should
 	// have its name derived from the field's name.
 	AutoPathName,
+	// NamedElems indicates that this slice field's elements are stored in
+	// files named by their string key field or get key method, with their
+	// order stored separately in an order file.
+	NamedElems,
 	// OmitEmpty means this field should only be written if it is not empty,
 	// according to the meaning of "not empty" defined by encoding/json.
 	OmitEmpty bool
@@ -107,7 +111,7 @@ func NewFieldInfo(f reflect.StructField) (*FieldInfo, error) {
 		keyType = f.Type.Key()
 		elemType = removePointer(f.Type.Elem())
 	}
-	if k == reflect.Slice {
+	if k == reflect.Slice || k == reflect.Array {
 		keyType = intType
 		elemType = removePointer(f.Type.Elem())
 	}
@@ -137,6 +141,45 @@ done:
 		"analysing field %s %s %# q", f.Name, f.Type, f.Tag)
 }
 
+// ElemDirFieldInfo returns field info for the elements of this map or slice
+// field when they are themselves maps or slices of type elemType, or nil if
+// they should be stored in files because this field's Tag.Depth is reached.
+// Only options which make sense at every nested level apply to the elements:
+// gaps, maxgap, pad, shard, shardhash, chunk and elemdirs, and marker for
+// nested maps, so that it applies to the innermost sets.
+func (fi *FieldInfo) ElemDirFieldInfo(elemType reflect.Type) *FieldInfo {
+	if !fi.IsDir || fi.Tag.Depth == 1 {
+		return nil
+	}
+	tag := Tag{
+		IsDir:      true,
+		ElemDirs:   fi.Tag.ElemDirs,
+		Marker:     fi.Tag.Marker && removePointer(elemType).Kind() == reflect.Map,
+		Gaps:       fi.Tag.Gaps,
+		MaxGap:     fi.Tag.MaxGap,
+		PadIndices: fi.Tag.PadIndices,
+		Shard:      fi.Tag.Shard,
+		ShardHash:  fi.Tag.ShardHash,
+		Chunk:      fi.Tag.Chunk,
+	}
+	if fi.Tag.Depth > 1 {
+		tag.Depth = fi.Tag.Depth - 1
+	}
+	elemFI := &FieldInfo{
+		Name:     fi.Name,
+		Type:     elemType,
+		ElemType: removePointer(removePointer(elemType).Elem()),
+		Tag:      tag,
+		IsDir:    true,
+	}
+	if t := removePointer(elemType); t.Kind() == reflect.Map {
+		elemFI.KeyType = t.Key()
+	} else {
+		elemFI.KeyType = intType
+	}
+	return elemFI
+}
+
 func removePointer(t reflect.Type) reflect.Type {
 	if t.Kind() == reflect.Ptr {
 		return t.Elem()
@@ -149,15 +192,24 @@ func (fi *FieldInfo) Validate() error {
 	if err := fi.validateKeyField(); err != nil {
 		return errors.Wrapf(err, "reading key field name")
 	}
-	//if err := validateName(fi.GetKeyName); err != nil {
-	//	return errors.Wrapf(err, "reading get key method name")
-	//}
-	//if err := validateName(fi.SetKeyName); err != nil {
-	//	return errors.Wrapf(err, "reading set key method name")
-	//}
+	if err := fi.validateGetKeyMethod(); err != nil {
+		return errors.Wrapf(err, "reading get key method name")
+	}
+	if err := fi.validateSetKeyMethod(); err != nil {
+		return errors.Wrapf(err, "reading set key method name")
+	}
 	return nil
 }
 
+// KeyName returns the name of the key field, or the get key method followed
+// by "()", for use in messages.
+func (fi *FieldInfo) KeyName() string {
+	if fi.GetKeyName != "" {
+		return fi.GetKeyName + "()"
+	}
+	return fi.KeyField
+}
+
 func (fi *FieldInfo) validateKeyField() error {
 	if fi.KeyField == "" {
 		return nil
@@ -171,13 +223,29 @@ func (fi *FieldInfo) validateKeyField() error {
 	if fi.ElemType.Kind() != reflect.Struct {
 		return errors.Errorf("element type %s not supported; must be struct", fi.ElemType)
 	}
-	if fi.KeyType.Kind() != reflect.String {
-		return errors.Errorf("key type %s not supported; must be string", fi.KeyType)
-	}
 	elemKeyField, ok := fi.ElemType.FieldByName(fi.KeyField)
 	if !ok {
 		return errors.Errorf("%s has no field %q", fi.ElemType, fi.KeyField)
 	}
+	if k := fi.Type.Kind(); k == reflect.Array && elemKeyField.Type.Kind() != reflect.Int {
+		// Arrays have a fixed length, so their elements cannot be named.
+		return errors.Errorf("%s.%s is %s; want int (from %s)",
+			fi.ElemType, elemKeyField.Name, elemKeyField.Type, fi.Type)
+	} else if k == reflect.Slice || k == reflect.Array {
+		// Slice elements may have their index set in an int key field, or be
+		// named by a string key field.
+		switch elemKeyField.Type.Kind() {
+		default:
+			return errors.Errorf("%s.%s is %s; want int or string (from %s)",
+				fi.ElemType, elemKeyField.Name, elemKeyField.Type, fi.Type)
+		case reflect.Int:
+		case reflect.String:
+			fi.NamedElems = true
+			fi.KeyType = elemKeyField.Type
+		}
+	} else if fi.KeyType.Kind() != reflect.String {
+		return errors.Errorf("key type %s not supported; must be string", fi.KeyType)
+	}
 	if elemKeyField.Type != fi.KeyType {
 		return errors.Errorf("%s.%s is %s; want %s (from %s)",
 			fi.ElemType, elemKeyField.Name, elemKeyField.Type, fi.KeyType, fi.Type)
@@ -186,19 +254,103 @@ func (fi *FieldInfo) validateKeyField() error {
 	ptrToElem := reflect.PtrTo(fi.ElemType)
 	setFuncType := reflect.FuncOf([]reflect.Type{ptrToElem, fi.KeyType}, nil, false)
 	fi.GetKeyFunc = reflect.MakeFunc(getFuncType, func(in []reflect.Value) []reflect.Value {
-		return []reflect.Value{in[0].FieldByName(fi.KeyField)}
+		key := fieldByIndex(in[0], elemKeyField.Index)
+		if !key.IsValid() {
+			// Promoted from a nil embedded pointer.
+			key = reflect.Zero(fi.KeyType)
+		}
+		return []reflect.Value{key}
 	})
 	fi.SetKeyFunc = reflect.MakeFunc(setFuncType, func(in []reflect.Value) []reflect.Value {
 		elem := in[0].Elem()
 		if !elem.IsValid() {
+			// A nil pointer element has no key field to set. It is read
+			// back as nil, with its key kept by its map or slice.
 			return nil
 		}
-		in[0].Elem().FieldByName(fi.KeyField).Set(in[1])
+		setFieldByIndex(elem, elemKeyField.Index).Set(in[1])
 		return nil
 	})
 	return nil
 }
 
+// validateGetKeyMethod checks that the get key method exists on a pointer to
+// the element type, and if so sets GetKeyFunc to call that method. Slice
+// elements with a get key method are named by the string it returns.
+func (fi *FieldInfo) validateGetKeyMethod() error {
+	if fi.GetKeyName == "" || fi.ElemType == nil {
+		return nil
+	}
+	if err := validateName(fi.GetKeyName); err != nil {
+		return err
+	}
+	ptrToElem := reflect.PtrTo(fi.ElemType)
+	method, ok := ptrToElem.MethodByName(fi.GetKeyName)
+	if !ok {
+		return errors.Errorf("%s has no method %q", ptrToElem, fi.GetKeyName)
+	}
+	keyType := fi.KeyType
+	if k := fi.Type.Kind(); k == reflect.Array {
+		// Arrays have a fixed length, so their elements cannot be named.
+		return errors.Errorf("get key method not supported for %s; use an int key field", fi.Type)
+	} else if k == reflect.Slice && method.Type.NumOut() == 1 &&
+		method.Type.Out(0).Kind() == reflect.String {
+		keyType = method.Type.Out(0)
+	}
+	getFuncType := reflect.FuncOf([]reflect.Type{ptrToElem}, []reflect.Type{keyType}, false)
+	if method.Type != getFuncType {
+		return errors.Errorf("%s.%s is %s; want %s",
+			ptrToElem, method.Name, method.Type, getFuncType)
+	}
+	if fi.Type.Kind() == reflect.Slice {
+		fi.NamedElems = true
+		fi.KeyType = keyType
+	}
+	fi.GetKeyFunc = reflect.MakeFunc(
+		reflect.FuncOf([]reflect.Type{fi.ElemType}, []reflect.Type{keyType}, false),
+		func(in []reflect.Value) []reflect.Value {
+			// The method may have a pointer receiver, so call it on a copy.
+			elem := reflect.New(fi.ElemType)
+			elem.Elem().Set(in[0])
+			return method.Func.Call([]reflect.Value{elem})
+		})
+	return nil
+}
+
+// validateSetKeyMethod checks that the set key method exists on a pointer to
+// the element type, and if so replaces SetKeyFunc with a call to that method.
+func (fi *FieldInfo) validateSetKeyMethod() error {
+	if fi.SetKeyName == "" || fi.ElemType == nil {
+		return nil
+	}
+	if err := validateName(fi.SetKeyName); err != nil {
+		return err
+	}
+	ptrToElem := reflect.PtrTo(fi.ElemType)
+	method, ok := ptrToElem.MethodByName(fi.SetKeyName)
+	if !ok {
+		return errors.Errorf("%s has no method %q", ptrToElem, fi.SetKeyName)
+	}
+	setFuncType := reflect.FuncOf([]reflect.Type{ptrToElem, fi.KeyType}, nil, false)
+	if method.Type != setFuncType {
+		return errors.Errorf("%s.%s is %s; want %s",
+			ptrToElem, method.Name, method.Type, setFuncType)
+	}
+	fi.SetKeyFunc = reflect.MakeFunc(setFuncType, func(in []reflect.Value) []reflect.Value {
+		if in[0].IsNil() {
+			return nil
+		}
+		return method.Func.Call(in)
+	})
+	return nil
+}
+
+// ElidesKeyField returns true if the key field of elements should be left out
+// of element files, because it is restored from the element's path on read.
+func (fi *FieldInfo) ElidesKeyField() bool {
+	return fi.KeyField != "" && !fi.Tag.KeepKey
+}
+
 func validateName(s string) error {
 	if len(s) == 0 {
 		return nil
@@ -49,11 +49,15 @@ type FieldInfoTestStruct struct {
 	KeyFieldTag3 MP `hy:"/,Name"` // AutoPathName + KeyField = "Name" + IsDir
 	KeyFieldTag4 MP `hy:",Name"`  // AutoPathName + KeyField = "Name" + IsDir
 
+	// hy key set tags
+	KeySet1 M  `hy:"/,Name,SetName()"` // AutoPathName + IsDir + KeyField = "Name" + SetKey = "SetName"
+	KeySet2 MP `hy:",Name,SetName()"`  // AutoPathName + KeyField = "Name" + SetKey = "SetName"
+
 	// hy key get/set tags
-	//KeyGetSet1 M  `hy:"/,GetName(),SetName()"` // AutoPathName + IsDir + GetKey = "GetName" + SetKey = "SetName"
-	//KeyGetSet2 M  `hy:",GetName(),SetName()"`  // AutoPathName + IsDir + GetKey = "GetName" + SetKey = "SetName"
-	//KeyGetSet3 MP `hy:"/,GetName(),SetName()"` // AutoPathName + IsDir + GetKey = "GetName" + SetKey = "SetName"
-	//KeyGetSet4 MP `hy:",GetName(),SetName()"`  // AutoPathName + IsDir + GetKey = "GetName" + SetKey = "SetName"
+	KeyGetSet1 M  `hy:"/,GetName(),SetName()"` // AutoPathName + IsDir + GetKey = "GetName" + SetKey = "SetName"
+	KeyGetSet2 M  `hy:",GetName(),SetName()"`  // AutoPathName + GetKey = "GetName" + SetKey = "SetName"
+	KeyGetSet3 MP `hy:"/,GetName(),SetName()"` // AutoPathName + IsDir + GetKey = "GetName" + SetKey = "SetName"
+	KeyGetSet4 MP `hy:",GetName(),SetName()"`  // AutoPathName + GetKey = "GetName" + SetKey = "SetName"
 }
 
 var fieldInfoGoodCalls = map[string]FieldInfo{
@@ -77,6 +81,14 @@ var fieldInfoGoodCalls = map[string]FieldInfo{
 	"KeyFieldTag2": {AutoPathName: true, KeyField: "Name"},
 	"KeyFieldTag3": {AutoPathName: true, KeyField: "Name", IsDir: true},
 	"KeyFieldTag4": {AutoPathName: true, KeyField: "Name"},
+
+	"KeySet1": {AutoPathName: true, KeyField: "Name", SetKeyName: "SetName", IsDir: true},
+	"KeySet2": {AutoPathName: true, KeyField: "Name", SetKeyName: "SetName"},
+
+	"KeyGetSet1": {AutoPathName: true, GetKeyName: "GetName", SetKeyName: "SetName", IsDir: true},
+	"KeyGetSet2": {AutoPathName: true, GetKeyName: "GetName", SetKeyName: "SetName"},
+	"KeyGetSet3": {AutoPathName: true, GetKeyName: "GetName", SetKeyName: "SetName", IsDir: true},
+	"KeyGetSet4": {AutoPathName: true, GetKeyName: "GetName", SetKeyName: "SetName"},
 }
 
 func TestNewFieldInfo_success(t *testing.T) {
@@ -175,10 +187,13 @@ type FieldInfoErrors struct {
 	IllegalGet8 M `hy:",GetName"` // no field named "GetName"
 	//IllegalGet9  M `hy:",GetName("`  // illegal token "GetName("
 	//IllegalGet10 M `hy:",GetName)"`  // illegal token "GetName)"
-	//IllegalGet11 M `hy:",Name()"`    // no method "Name"
-	//IllegalGet12 M `hy:",SetName()"` // wrong signature
+	IllegalGet11 M `hy:",Name()"`    // no method "Name"
+	IllegalGet12 M `hy:",SetName()"` // wrong signature
 
-	//IllegalSet1 M `hy:",,Name()"`   // No method called "Name"
+	IllegalArrayKey    [2]A `hy:",Name"`      // array elements cannot be named
+	IllegalArrayGetKey [2]A `hy:",GetName()"` // array elements cannot be named
+
+	IllegalSet1 M `hy:",,Name()"` // No method called "Name"
 	//IllegalSet2 M `hy:",,SetName"`  // setter must end with ()
 	//IllegalSet3 M `hy:",,SetName("` // illegal token "SetName("
 	//IllegalSet4 M `hy:",,SetName)"` // illegal token "SetName)"
@@ -202,10 +217,13 @@ var newFieldInfoBadCalls = map[string]string{
 	//"IllegalGet9":  `reading key field name: illegal token "GetName("`,
 	//"IllegalGet10": `reading key field name: illegal token "GetName)"`,
 
-	//"IllegalGet11": `reading get key method name: *hy.A has no method "Name"`,
-	//"IllegalGet12": `reading get key method name: *hy.Ai.SetName() has wrong signature`,
+	"IllegalGet11": `reading get key method name: *hy.A has no method "Name"`,
+	"IllegalGet12": `reading get key method name: *hy.A.SetName is func(*hy.A, string); want func(*hy.A) string`,
+
+	"IllegalArrayKey":    `reading key field name: hy.A.Name is string; want int (from [2]hy.A)`,
+	"IllegalArrayGetKey": `reading get key method name: get key method not supported for [2]hy.A; use an int key field`,
 
-	//"IllegalSet1": `*hy.A has no method called "Name" for set key func name in`,
+	"IllegalSet1": `reading set key method name: *hy.A has no method "Name"`,
 	//"IllegalSet2": `reading set key method name: setter should end with "()"`,
 	//"IllegalSet3": `reading set key method name: illegal token "SetName("`,
 	//"IllegalSet4": `reading set key method name: illegal token "SetName)"`,
@@ -2,6 +2,10 @@ package hy
 
 import "github.com/pkg/errors"
 
+// MarkerFile is the value of a file target which is an empty marker file. Its
+// presence is all it represents, so its contents are never read.
+type MarkerFile struct{}
+
 // FileTarget represents a target file to be written.
 type FileTarget struct {
 	FilePath string
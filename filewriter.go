@@ -6,6 +6,8 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -17,6 +19,14 @@ type FileWriter interface {
 	WriteFile(prefix string, target WriteTarget) error
 }
 
+// FileSetWriter is a FileWriter which writes all the targets of a write
+// together, rather than one at a time.
+type FileSetWriter interface {
+	FileWriter
+	// WriteFiles writes a file representing each of targets.
+	WriteFiles(prefix string, targets []WriteTarget) error
+}
+
 // FileReader reads data from prefix + target.Path() into target.Data.
 type FileReader interface {
 	ReadFile(prefix, filePath string, v interface{}) error
@@ -32,8 +42,21 @@ type FileMarshaler struct {
 	// format written and read by MarshalFunc and UnmarshalFunc.
 	FileExtension,
 	// RootFileName is the name of the root struct, which will be written only
-	// if the root is a struct with ordinary fields (not in a file or dir).
+	// if the root is a struct with ordinary fields (not in a file or dir). It
+	// is also the name of files stored inside the directory they belong to.
 	RootFileName string
+	// BlobDir is the directory, relative to the prefix, in which the content
+	// of each file written is stored once, named by its SHA-256 hash. Each
+	// file in the tree is then a symlink to its blob. If empty, files are
+	// written directly.
+	BlobDir string
+	// BlobPointers indicates that files in the tree refer to their blobs by
+	// pointer files, rather than symlinks.
+	BlobPointers bool
+	// LinkShared indicates that files with the same content as a file
+	// earlier in path order are written as symlinks to that file by
+	// WriteFiles. It has no effect if BlobDir is set.
+	LinkShared bool
 }
 
 // JSONWriter is a FileWriter configured to marshal JSON.
@@ -46,11 +69,14 @@ var JSONWriter = FileMarshaler{
 
 // ReadFile reads a file at prefix + t.Path into v.
 func (fm FileMarshaler) ReadFile(prefix, filePath string, v interface{}) error {
-	if filePath == "" {
-		filePath = fm.RootFileName
+	if filePath == "" || strings.HasSuffix(filePath, "/") {
+		filePath += fm.RootFileName
 	}
 	filePath = filepath.Join(prefix, filePath)
 	b, err := ioutil.ReadFile(filePath + "." + fm.FileExtension)
+	if err == nil {
+		b, err = fm.readBlob(prefix, b)
+	}
 	if err != nil {
 		return errors.Wrapf(err, "reading target file %q", filePath)
 	}
@@ -60,22 +86,98 @@ func (fm FileMarshaler) ReadFile(prefix, filePath string, v interface{}) error {
 	return nil
 }
 
+// WriteFiles writes a file for each of targets, in path order. If LinkShared
+// is set, files with the same content as an earlier file are written as
+// symlinks to it.
+func (fm FileMarshaler) WriteFiles(prefix string, targets []WriteTarget) error {
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Path() < targets[j].Path() })
+	if !fm.LinkShared || fm.BlobDir != "" {
+		for _, t := range targets {
+			if err := fm.WriteFile(prefix, t); err != nil {
+				return errors.Wrapf(err, "writing target %q", t.Path())
+			}
+		}
+		return nil
+	}
+	canonical := map[string]string{}
+	for _, t := range targets {
+		p, err := fm.prepareFile(prefix, t)
+		if err != nil {
+			return errors.Wrapf(err, "writing target %q", t.Path())
+		}
+		if _, isMarker := t.Data().(MarkerFile); isMarker {
+			err = ioutil.WriteFile(p, nil, 0644)
+		} else {
+			err = fm.writeShared(p, t, canonical)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "writing target %q", t.Path())
+		}
+	}
+	return nil
+}
+
+// writeShared writes the file at p for t, as a symlink if canonical maps its
+// content to the path of a file already written.
+func (fm FileMarshaler) writeShared(p string, t WriteTarget, canonical map[string]string) error {
+	b, err := fm.MarshalFunc(t.Data())
+	if err != nil {
+		return errors.Wrapf(err, "marshalling data")
+	}
+	other, ok := canonical[string(b)]
+	if !ok {
+		canonical[string(b)] = p
+		return errors.Wrapf(ioutil.WriteFile(p, b, 0644), "writing file")
+	}
+	target, err := filepath.Rel(filepath.Dir(p), other)
+	if err != nil {
+		return errors.Wrapf(err, "linking to %q", other)
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "replacing file")
+	}
+	return errors.Wrapf(os.Symlink(target, p), "linking to %q", other)
+}
+
 // WriteFile writes a file based on t.
 func (fm FileMarshaler) WriteFile(prefix string, t WriteTarget) error {
+	p, err := fm.prepareFile(prefix, t)
+	if err != nil {
+		return err
+	}
+	_, isMarker := t.Data().(MarkerFile)
+	if isMarker {
+		// Marker files are empty, so there is nothing to share.
+		return errors.Wrapf(ioutil.WriteFile(p, nil, 0644), "writing file")
+	}
+	b, err := fm.MarshalFunc(t.Data())
+	if err != nil {
+		return errors.Wrapf(err, "marshalling data")
+	}
+	if fm.BlobDir != "" {
+		return errors.Wrapf(fm.writeBlob(prefix, p, b), "writing file")
+	}
+	return errors.Wrapf(ioutil.WriteFile(p, b, 0644), "writing file")
+}
+
+// prepareFile returns the path of the file for t, creating its directory and
+// removing any existing symlink there, so that its target is not overwritten.
+func (fm FileMarshaler) prepareFile(prefix string, t WriteTarget) (string, error) {
 	p := t.Path()
-	if p == "" {
-		p = fm.RootFileName
+	if p == "" || strings.HasSuffix(p, "/") {
+		p += fm.RootFileName
 	}
 	p = path.Join(prefix, p+"."+fm.FileExtension)
 	dir := path.Dir(p)
 	if dir != "" {
 		if err := os.MkdirAll(dir, 0755); err != nil {
-			return errors.Wrapf(err, "creating directory %q", dir)
+			return p, errors.Wrapf(err, "creating directory %q", dir)
 		}
 	}
-	b, err := fm.MarshalFunc(t.Data())
-	if err != nil {
-		return errors.Wrapf(err, "marshalling data")
+	if fi, err := os.Lstat(p); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(p); err != nil {
+			return p, errors.Wrapf(err, "removing symlink")
+		}
 	}
-	return errors.Wrapf(ioutil.WriteFile(p, b, 0644), "writing file")
+	return p, nil
 }
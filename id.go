@@ -15,35 +15,45 @@ type NodeID struct {
 	Type reflect.Type
 	// IsPtr indicates if OwnType is a pointer really.
 	IsPtr bool
+	// IsPtrPtr indicates if OwnType is a pointer to a pointer really. IsPtr
+	// is also true.
+	IsPtrPtr bool
 	// IsLeaf indicates if this node can only be a leaf.
 	IsLeaf bool
 	// FieldName is the name of the parent field containing this node. FieldName
 	// will be empty unless ParentType is a struct.
 	FieldName string
+	// Tag is the tag of the map or slice field containing this node. It is
+	// the zero Tag unless ParentType is a map or slice. Elements of maps and
+	// slices of the same type are distinct nodes when their tags differ.
+	Tag Tag
 }
 
 // NewNodeID creates a new node ID.
 func NewNodeID(parentType, typ reflect.Type, fieldName string) (NodeID, error) {
 	t := typ
-	var isPtr bool
+	var isPtr, isPtrPtr bool
 	k := t.Kind()
 	if k == reflect.Ptr {
 		isPtr = true
 		t = t.Elem()
 		k = t.Kind()
+	}
+	if k == reflect.Ptr {
+		isPtrPtr = true
+		t = t.Elem()
+		k = t.Kind()
 		if k == reflect.Ptr {
-			return NodeID{}, errors.New("cannot analyse pointer to pointer")
+			return NodeID{}, errors.New("cannot analyse pointer to pointer to pointer")
 		}
 	}
-	if k == reflect.Interface {
-		// TODO: We should allow interfaces that implement map.Get/Set and elem.GetID/SetID.
-		return NodeID{}, errors.New("cannot analyse kind interface")
-	}
-	isLeaf := (k != reflect.Struct && k != reflect.Map && k != reflect.Slice)
+	isLeaf := (k != reflect.Struct && k != reflect.Map && k != reflect.Slice &&
+		k != reflect.Array && k != reflect.Interface)
 	return NodeID{
 		ParentType: parentType,
 		Type:       t,
 		IsPtr:      isPtr,
+		IsPtrPtr:   isPtrPtr,
 		IsLeaf:     isLeaf,
 		FieldName:  fieldName,
 	}, nil
@@ -54,6 +64,9 @@ func (id NodeID) String() string {
 	if id.IsPtr {
 		ptr = "*"
 	}
+	if id.IsPtrPtr {
+		ptr = "**"
+	}
 	parent := "nil"
 	if id.ParentType != nil {
 		parent = id.ParentType.String()
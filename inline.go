@@ -0,0 +1,139 @@
+package hy
+
+import (
+	"reflect"
+)
+
+// An inlineType converts values of a struct type stored inline in a file to
+// and from a struct type without its hy tagged fields, which are stored in
+// their own files instead.
+type inlineType struct {
+	// Type is the inline struct type.
+	Type,
+	// FileType is the type stored in the file in place of Type.
+	FileType reflect.Type
+	// index is the index sequence in Type of each field of FileType.
+	index [][]int
+	// fields is the inlineType of each field of FileType, or nil if that
+	// field is stored as it is.
+	fields []*inlineType
+}
+
+// newInlineType returns an inlineType for the inline field type t, or nil if
+// t is not a struct or pointer to struct with hy tagged fields, directly or
+// within its own inline struct fields. It also returns t's hy tagged fields,
+// with their names prefixed by the names of the inline fields containing
+// them, and their index sequences relative to t.
+func newInlineType(t reflect.Type, visiting map[reflect.Type]bool) (*inlineType, []reflect.StructField) {
+	t = removePointer(t)
+	if t.Kind() != reflect.Struct || visiting[t] {
+		return nil, nil
+	}
+	visiting[t] = true
+	defer delete(visiting, t)
+	fields, err := structFields(t)
+	if err != nil {
+		// Left to encoding/json to report.
+		return nil, nil
+	}
+	it := &inlineType{Type: t}
+	var fileFields []reflect.StructField
+	var tagged []reflect.StructField
+	for _, sf := range fields {
+		if _, ok := sf.Tag.Lookup("hy"); ok {
+			if sf.Tag.Get("hy") != "-" {
+				tagged = append(tagged, sf)
+			}
+			continue
+		}
+		if sf.PkgPath != "" {
+			// Unexported embedded non-struct types are ignored, as by
+			// encoding/json.
+			continue
+		}
+		ft := sf.Type
+		fieldType, fieldTagged := newInlineType(sf.Type, visiting)
+		if fieldType != nil {
+			ft = fieldType.FileTypeOf(sf.Type)
+			for _, child := range fieldTagged {
+				child.Name = sf.Name + "." + child.Name
+				child.Index = append(append([]int(nil), sf.Index...), child.Index...)
+				tagged = append(tagged, child)
+			}
+		}
+		it.index = append(it.index, sf.Index)
+		it.fields = append(it.fields, fieldType)
+		fileFields = append(fileFields, reflect.StructField{
+			Name: sf.Name,
+			Type: ft,
+			Tag:  sf.Tag,
+		})
+	}
+	if len(tagged) == 0 {
+		return nil, nil
+	}
+	it.FileType = reflect.StructOf(fileFields)
+	return it, tagged
+}
+
+// FileTypeOf returns FileType, or a pointer to FileType if t is a pointer.
+func (it *inlineType) FileTypeOf(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Ptr {
+		return reflect.PtrTo(it.FileType)
+	}
+	return it.FileType
+}
+
+// ToFile converts v, of Type or a pointer to Type, to a FileType value or
+// pointer.
+func (it *inlineType) ToFile(v reflect.Value) reflect.Value {
+	return it.convert(v, it.FileType, func(v reflect.Value) reflect.Value {
+		out := reflect.New(it.FileType).Elem()
+		for i, index := range it.index {
+			f := fieldByIndex(v, index)
+			if !f.IsValid() {
+				// Promoted from a nil embedded pointer.
+				continue
+			}
+			if it.fields[i] != nil {
+				f = it.fields[i].ToFile(f)
+			}
+			out.Field(i).Set(f)
+		}
+		return out
+	})
+}
+
+// FromFile converts v, of FileType or a pointer to FileType, to a Type value
+// or pointer.
+func (it *inlineType) FromFile(v reflect.Value) reflect.Value {
+	return it.convert(v, it.Type, func(v reflect.Value) reflect.Value {
+		out := reflect.New(it.Type).Elem()
+		for i, index := range it.index {
+			f := v.Field(i)
+			if f.IsZero() {
+				// Leave embedded pointers nil.
+				continue
+			}
+			if it.fields[i] != nil {
+				f = it.fields[i].FromFile(f)
+			}
+			setFieldByIndex(out, index).Set(f)
+		}
+		return out
+	})
+}
+
+// convert converts the struct or pointer to struct v to a value of struct
+// type t, or a pointer to t, using convertStruct.
+func (it *inlineType) convert(v reflect.Value, t reflect.Type, convertStruct func(reflect.Value) reflect.Value) reflect.Value {
+	if v.Kind() != reflect.Ptr {
+		return convertStruct(v)
+	}
+	if v.IsNil() {
+		return reflect.Zero(reflect.PtrTo(t))
+	}
+	out := reflect.New(t)
+	out.Elem().Set(convertStruct(v.Elem()))
+	return out
+}
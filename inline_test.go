@@ -0,0 +1,188 @@
+package hy
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type (
+	InlineOuter struct {
+		Name    string
+		Meta    InlineMeta
+		MetaPtr *InlineMeta
+		NilPtr  *InlineMeta
+	}
+	InlineMeta struct {
+		Version int
+		Detail  InlineDetail
+		File    StructB            `hy:"file"`
+		Map     map[string]StructB `hy:"map/"`
+	}
+	InlineDetail struct {
+		Label string
+		Deep  StructB `hy:"deep"`
+	}
+)
+
+func TestStructNode_inlineChildren(t *testing.T) {
+	in := InlineOuter{
+		Name: "outer",
+		Meta: InlineMeta{
+			Version: 1,
+			Detail:  InlineDetail{Label: "detail", Deep: StructB{Name: "deep"}},
+			File:    StructB{Name: "file"},
+			Map:     map[string]StructB{"a": {Name: "a"}},
+		},
+		MetaPtr: &InlineMeta{
+			Version: 2,
+			File:    StructB{Name: "ptr file"},
+		},
+	}
+	var out InlineOuter
+	c := newTestCodec(func(c *Codec) { c.PathNames = KebabCase })
+	prefix := roundTrip(t, c, "inline-children", in, &out)
+
+	expectedFiles := map[string]string{
+		"_": `{"Meta":{"Detail":{"Label":"detail"},"Version":1},` +
+			`"MetaPtr":{"Detail":{"Label":""},"Version":2},"Name":"outer","NilPtr":null}`,
+		"meta/file":        `{"Name":"file"}`,
+		"meta/map/a":       `{"Name":"a"}`,
+		"meta/detail/deep": `{"Name":"deep"}`,
+		"meta-ptr/file":    `{"Name":"ptr file"}`,
+	}
+	for path, expected := range expectedFiles {
+		if actual := readTestFile(t, prefix, path); actual != expected {
+			t.Errorf("got %s at %q; want %s", actual, path, expected)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(prefix, "nil-ptr")); !os.IsNotExist(err) {
+		t.Errorf("got %v for nil-ptr; want not exist", err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got %+v; want %+v", out, in)
+	}
+}
+
+func TestStructNode_inlineChildren_failure(t *testing.T) {
+	type (
+		inlineEntries struct {
+			Entries map[string]StructB `hy:".,entries"`
+		}
+		entriesInInline struct {
+			Inline inlineEntries
+		}
+		inlineCollision struct {
+			Meta InlineMeta
+			File StructB `hy:"Meta/file"`
+		}
+	)
+	c := NewCodec()
+	for expected, input := range map[string]interface{}{
+		"has entries option; must not be within an inline field": entriesInInline{},
+		`both have path name "Meta/file"`:                        inlineCollision{},
+	} {
+		_, err := c.Analyse(input)
+		if err == nil {
+			t.Errorf("got nil error for %T; want error containing %q", input, expected)
+			continue
+		}
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("got error %q for %T; want it to contain %q", err, input, expected)
+		}
+	}
+}
+
+type (
+	SpillStruct struct {
+		Name  string
+		Cert  string
+		Lines []string
+		Child SpillChild `hy:"child"`
+	}
+	SpillChild struct {
+		Notes string
+	}
+)
+
+func TestStructNode_spill(t *testing.T) {
+	cert := strings.Repeat("certificate ", 10)
+	in := SpillStruct{
+		Name:  "spill",
+		Cert:  cert,
+		Lines: []string{"short"},
+		Child: SpillChild{Notes: cert},
+	}
+	var out SpillStruct
+	c := newTestCodec(func(c *Codec) { c.SpillSize = 20 })
+	prefix := roundTrip(t, c, "inline-spill", in, &out)
+
+	expectedFiles := map[string]string{
+		"_":           `{"Lines":["short"],"Name":"spill","spilled":["Cert"]}`,
+		"Cert":        `"` + cert + `"`,
+		"child":       `{"spilled":["Notes"]}`,
+		"child/Notes": `"` + cert + `"`,
+	}
+	for path, expected := range expectedFiles {
+		if actual := readTestFile(t, prefix, path); actual != expected {
+			t.Errorf("got %s at %q; want %s", actual, path, expected)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(prefix, "Lines.json")); !os.IsNotExist(err) {
+		t.Errorf("got %v for Lines.json; want not exist", err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got %+v; want %+v", out, in)
+	}
+
+	// A stale spill file is ignored once its value is back in the struct's
+	// file.
+	small := in
+	small.Cert = "small"
+	if err := c.Write(prefix, small); err != nil {
+		t.Fatal(err)
+	}
+	out = SpillStruct{}
+	if err := c.Read(prefix, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, small) {
+		t.Errorf("got %+v; want %+v", out, small)
+	}
+
+	if err := c.Write(prefix, in); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(prefix, "Cert.json")); err != nil {
+		t.Fatal(err)
+	}
+	err := c.Read(prefix, &SpillStruct{})
+	if expected := `spilled field Cert has no file "Cert"`; err == nil ||
+		!strings.Contains(err.Error(), expected) {
+		t.Errorf("got error %v; want it to contain %q", err, expected)
+	}
+}
+
+func TestStructNode_spill_failure(t *testing.T) {
+	type (
+		spillFieldName struct {
+			Spilled []string `json:"spilled"`
+		}
+		spillPathName struct {
+			Cert  string
+			Other StructB `hy:"Cert"`
+		}
+	)
+	c := NewCodec(func(c *Codec) { c.SpillSize = 20 })
+	for expected, input := range map[string]interface{}{
+		`has the same name as spill field "spilled"`:                                         spillFieldName{},
+		`fields hy.spillPathName.Cert and hy.spillPathName.Other both have path name "Cert"`: spillPathName{},
+	} {
+		_, err := c.Analyse(input)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("got error %v for %T; want it to contain %q", err, input, expected)
+		}
+	}
+}
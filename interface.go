@@ -0,0 +1,243 @@
+package hy
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// An InterfaceNode represents an interface field or element, stored as the
+// registered concrete type of its value.
+type InterfaceNode struct {
+	NodeBase
+	// Concrete maps the registered names of types implementing this node's
+	// interface to their nodes.
+	Concrete map[string]*Node
+	// TypeSuffix indicates the name of the concrete type is stored as a suffix
+	// of the file or directory name, e.g. "cache.redis".
+	TypeSuffix bool
+	// TypeField is the name of the field storing the name of the concrete
+	// type in the file, unless TypeSuffix is true.
+	TypeField string
+	// names maps concrete types to their registered names.
+	names map[reflect.Type]string
+	// errs maps the registered names of types implementing this node's
+	// interface which cannot be stored here to the reason why. It is
+	// returned when writing or reading values of those types.
+	errs map[string]error
+}
+
+// NewInterfaceNode makes a new interface node, analysing each registered type
+// implementing its interface.
+func (c *Codec) NewInterfaceNode(base NodeBase) (Node, error) {
+	n := &InterfaceNode{
+		NodeBase:  base,
+		Concrete:  map[string]*Node{},
+		TypeField: c.TypeField,
+		names:     map[reflect.Type]string{},
+		errs:      map[string]error{},
+	}
+	n.TypeSuffix = n.Field != nil && n.Field.Tag.TypeSuffix
+	names := make([]string, 0, len(c.types))
+	for name := range c.types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t := c.types[name]
+		if !t.Implements(n.Type) {
+			continue
+		}
+		// Concrete nodes share this node's parent, so they are stored as
+		// this node would be, but are distinguished from other nodes of
+		// the same type by having this node's type as their parent type.
+		id, err := NewNodeID(n.Type, t, n.FieldName)
+		if err != nil {
+			return n, errors.Wrapf(err, "analysing type %q", name)
+		}
+		id.Tag = n.Tag
+		n.names[t] = name
+		concrete, err := c.NewNode(n.Parent, id, n.Field)
+		if err == nil && !n.TypeSuffix {
+			err = n.checkTypeField(*concrete)
+		}
+		if err != nil {
+			n.errs[name] = errors.Wrapf(err, "analysing type %q", name)
+			continue
+		}
+		n.Concrete[name] = concrete
+	}
+	return n, nil
+}
+
+// checkTypeField returns an error if the type field cannot be stored in the
+// file of concrete.
+func (n *InterfaceNode) checkTypeField(concrete Node) error {
+	s, ok := concrete.(*StructNode)
+	if !ok {
+		return errors.Errorf("type field %q needs a struct; %s is %s (use typesuffix)",
+			n.TypeField, concrete.ID().Type, concrete.ID().Type.Kind())
+	}
+	for name, fileName := range s.FieldNames {
+		if fileName == n.TypeField {
+			return errors.Errorf("field %s.%s has the same name as type field %q",
+				s.Type, name, n.TypeField)
+		}
+	}
+	return nil
+}
+
+// ChildPathName returns an empty string; the children of the concrete value
+// are named by its own node.
+func (n *InterfaceNode) ChildPathName(child Node, key, val reflect.Value) string {
+	return ""
+}
+
+// WriteTargets writes the concrete value held by val, and the name of its type.
+func (n *InterfaceNode) WriteTargets(c WriteContext, key, val reflect.Value) error {
+	if !val.IsValid() || val.IsNil() {
+		if n.HasKey {
+			// Written like a nil pointer element, so its key is kept.
+			return errors.Wrap(c.SetValue(nil), "writing nil interface")
+		}
+		return nil
+	}
+	elem := val.Elem()
+	name, ok := n.names[elem.Type()]
+	if !ok {
+		return errors.Errorf("type %s is not registered for %s", elem.Type(), n.Type)
+	}
+	if err := n.errs[name]; err != nil {
+		return err
+	}
+	concrete := *n.Concrete[name]
+	if elem.Kind() == reflect.Ptr {
+		if elem.IsNil() {
+			return errors.Errorf("cannot write nil %s", elem.Type())
+		}
+		elem = elem.Elem()
+	}
+	if n.TypeSuffix {
+		suffixed := c.Parent.Push(c.PathName + "." + name)
+		return errors.Wrapf(concrete.WriteTargets(suffixed, key, elem), "writing %q", name)
+	}
+	// The type field is written with the struct's own fields, so the
+	// struct's file is written even if it has no fields of its own.
+	typeField := map[string]interface{}{n.TypeField: name}
+	return errors.Wrapf(concrete.(*StructNode).writeTargets(c, elem, typeField),
+		"writing %q", name)
+}
+
+// ReadTargets reads the concrete value stored at c, returning it as a value of
+// this node's interface type. If nothing is stored at c, it returns a nil
+// interface value.
+func (n *InterfaceNode) ReadTargets(c ReadContext, key reflect.Value) (reflect.Value, error) {
+	val := reflect.New(n.Type).Elem()
+	name, typedContext, err := n.typedContext(c)
+	if err != nil || name == "" {
+		return val, err
+	}
+	v, err := (*n.Concrete[name]).Read(typedContext, key)
+	if err != nil {
+		return val, errors.Wrapf(err, "reading %q", name)
+	}
+	val.Set(v)
+	return val, nil
+}
+
+// typeNames returns the names of all registered types implementing this
+// node's interface, including those which cannot be stored here.
+func (n *InterfaceNode) typeNames() []string {
+	names := make([]string, 0, len(n.names))
+	for _, name := range n.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Exists returns true if a value is stored at c.
+func (n *InterfaceNode) Exists(c ReadContext) bool {
+	if !n.TypeSuffix {
+		return c.Exists()
+	}
+	for _, name := range n.typeNames() {
+		if c.Parent.Push(c.PathName + "." + name).Exists() {
+			return true
+		}
+	}
+	return c.IsFile()
+}
+
+// typedContext returns the registered name of the type stored at c and the
+// context it is stored at, which differs from c if TypeSuffix is true. It
+// returns an empty name if nothing, or a nil interface, is stored at c.
+func (n *InterfaceNode) typedContext(c ReadContext) (string, ReadContext, error) {
+	if n.TypeSuffix {
+		var found []string
+		for _, name := range n.typeNames() {
+			if c.Parent.Push(c.PathName + "." + name).Exists() {
+				found = append(found, name)
+			}
+		}
+		switch len(found) {
+		case 0:
+			return "", c, nil
+		case 1:
+			return found[0], c.Parent.Push(c.PathName + "." + found[0]), n.errs[found[0]]
+		}
+		return "", c, errors.Errorf("%q stored as more than one type: %s",
+			c.PathName, strings.Join(found, ", "))
+	}
+	var data map[string]interface{}
+	var err error
+	if c.IsFile() {
+		err = c.Read(&data)
+	} else if c.IsDirFile() {
+		err = c.ReadDir(&data)
+	}
+	if err != nil || data == nil {
+		return "", c, err
+	}
+	name, _ := data[n.TypeField].(string)
+	if name == "" {
+		return "", c, errors.Errorf("type field %q missing at %q", n.TypeField, c.Path())
+	}
+	if err := n.errs[name]; err != nil {
+		return "", c, err
+	}
+	if _, ok := n.Concrete[name]; !ok {
+		// Not in errs either, so not registered.
+		return "", c, errors.Errorf("type %q at %q is not registered for %s",
+			name, c.Path(), n.Type)
+	}
+	return name, c, nil
+}
+
+// trimTypeSuffixes returns the element names in list with any type suffixes
+// of elemNode removed, if it is an InterfaceNode storing them.
+func trimTypeSuffixes(elemNode Node, list []string) []string {
+	in, ok := elemNode.(*InterfaceNode)
+	if !ok || !in.TypeSuffix {
+		return list
+	}
+	typeNames := map[string]bool{}
+	for _, name := range in.names {
+		typeNames[name] = true
+	}
+	seen := map[string]bool{}
+	names := list[:0]
+	for _, name := range list {
+		if i := strings.LastIndex(name, "."); i != -1 && typeNames[name[i+1:]] {
+			name = name[:i]
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,145 @@
+package hy
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type (
+	Plugin interface {
+		PluginName() string
+	}
+	RedisPlugin struct {
+		Addr   string
+		Config StructB `hy:"config"`
+	}
+	FilePlugin struct {
+		Path string
+	}
+	SplitPlugin struct {
+		Config StructB `hy:"config"`
+	}
+	NamePlugin      string
+	CollidingPlugin struct {
+		Type string `json:"type"`
+	}
+	PluginStruct struct {
+		Cache    Plugin            `hy:"cache"`
+		Plugins  map[string]Plugin `hy:"plugins/"`
+		Suffixed map[string]Plugin `hy:"suffixed/,typesuffix"`
+		Field    Plugin            `hy:"field,typesuffix"`
+		Dirs     []Plugin          `hy:"dirs/,elemdirs"`
+		Nil      Plugin            `hy:"nil"`
+	}
+)
+
+func (p RedisPlugin) PluginName() string      { return "redis" }
+func (p *FilePlugin) PluginName() string      { return "file" }
+func (p NamePlugin) PluginName() string       { return string(p) }
+func (p SplitPlugin) PluginName() string      { return "split" }
+func (p *CollidingPlugin) PluginName() string { return "colliding" }
+
+func newPluginCodec(t *testing.T) *Codec {
+	c := newTestCodec()
+	for name, v := range map[string]interface{}{
+		"redis": RedisPlugin{},
+		"file":  &FilePlugin{},
+		"name":  NamePlugin(""),
+		"split": SplitPlugin{},
+	} {
+		if err := c.RegisterType(name, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c
+}
+
+func TestInterfaceNode(t *testing.T) {
+	in := PluginStruct{
+		Cache: RedisPlugin{Addr: "localhost", Config: StructB{Name: "config"}},
+		Plugins: map[string]Plugin{
+			"redis": RedisPlugin{Addr: "remote"},
+			"file":  &FilePlugin{Path: "/tmp"},
+			"split": SplitPlugin{Config: StructB{Name: "split"}},
+			"nil":   nil,
+		},
+		Suffixed: map[string]Plugin{
+			"cache": RedisPlugin{Addr: "suffixed", Config: StructB{Name: "config"}},
+			"name":  NamePlugin("a name"),
+		},
+		Field: NamePlugin("field"),
+		Dirs:  []Plugin{&FilePlugin{Path: "dir"}},
+	}
+	var out PluginStruct
+	prefix := roundTrip(t, newPluginCodec(t), "interface", in, &out)
+
+	expectedFiles := map[string]string{
+		"cache":                       `{"Addr":"localhost","type":"redis"}`,
+		"cache/config":                `{"Name":"config"}`,
+		"plugins/redis":               `{"Addr":"remote","type":"redis"}`,
+		"plugins/file":                `{"Path":"/tmp","type":"file"}`,
+		"plugins/nil":                 `null`,
+		"plugins/split":               `{"type":"split"}`,
+		"plugins/split/config":        `{"Name":"split"}`,
+		"suffixed/cache.redis":        `{"Addr":"suffixed"}`,
+		"suffixed/cache.redis/config": `{"Name":"config"}`,
+		"suffixed/name.name":          `"a name"`,
+		"field.name":                  `"field"`,
+		"dirs/0/_":                    `{"Path":"dir","type":"file"}`,
+	}
+	for path, expected := range expectedFiles {
+		if actual := readTestFile(t, prefix, path); actual != expected {
+			t.Errorf("got %s at %q; want %s", actual, path, expected)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(prefix, "nil.json")); !os.IsNotExist(err) {
+		t.Errorf("got %v for nil.json; want not exist", err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got %+v; want %+v", out, in)
+	}
+}
+
+func TestInterfaceNode_failure(t *testing.T) {
+	type typeFieldStruct struct {
+		Plugin Plugin `hy:"plugin"`
+	}
+	c := newPluginCodec(t)
+	err := c.Write(filepath.Join(t.TempDir(), "interface-failure"), typeFieldStruct{NamePlugin("name")})
+	if expected := `type field "type" needs a struct; hy.NamePlugin is string (use typesuffix)`; err == nil ||
+		!strings.Contains(err.Error(), expected) {
+		t.Errorf("got error %v; want it to contain %q", err, expected)
+	}
+
+	c = newTestCodec()
+	if err := c.RegisterType("colliding", &CollidingPlugin{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RegisterType("other", &CollidingPlugin{}); err == nil {
+		t.Errorf("got nil error registering a type twice")
+	}
+	if err := c.RegisterType("a.b", RedisPlugin{}); err == nil {
+		t.Errorf("got nil error registering a name containing a dot")
+	}
+	err = c.Write(filepath.Join(t.TempDir(), "interface-failure"), typeFieldStruct{&CollidingPlugin{}})
+	if expected := `field hy.CollidingPlugin.Type has the same name as type field "type"`; err == nil ||
+		!strings.Contains(err.Error(), expected) {
+		t.Errorf("got error %v; want it to contain %q", err, expected)
+	}
+	err = c.RegisterType("redis", RedisPlugin{})
+	if expected := `cannot register type "redis" after analysis`; err == nil ||
+		!strings.Contains(err.Error(), expected) {
+		t.Errorf("got error %v; want it to contain %q", err, expected)
+	}
+
+	c = newTestCodec()
+	in := PluginStruct{Cache: &FilePlugin{Path: "unregistered"}}
+	err = c.Write(filepath.Join(t.TempDir(), "interface-failure"), in)
+	if expected := `type *hy.FilePlugin is not registered for hy.Plugin`; err == nil ||
+		!strings.Contains(err.Error(), expected) {
+		t.Errorf("got error %v; want it to contain %q", err, expected)
+	}
+}
@@ -1,8 +1,12 @@
 package hy
 
 import (
+	"crypto/sha1"
 	"fmt"
+	"path"
 	"reflect"
+	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -11,6 +15,10 @@ import (
 type MapNode struct {
 	*DirNodeBase
 	KeyType reflect.Type
+	// KeySegments are the names of the fields of a struct KeyType, in the
+	// order they appear as path segments. It is nil unless KeyType is a
+	// struct.
+	KeySegments []string
 }
 
 // NewMapNode makes a new map node.
@@ -21,57 +29,367 @@ func (c *Codec) NewMapNode(base NodeBase) (Node, error) {
 		},
 		KeyType: base.Type.Key(),
 	}
-	return n, errors.Wrap(n.AnalyseElemNode(n, c), "analysing map element node")
+	if err := n.analyseKeySegments(); err != nil {
+		return n, errors.Wrapf(err, "analysing key type %s", n.KeyType)
+	}
+	if n.nestedKeys() && n.KeyType.Kind() != reflect.String {
+		return n, errors.Errorf("nestedkeys needs string keys; key type is %s", n.KeyType)
+	}
+	if n.sharded() && (n.KeySegments != nil || n.nestedKeys()) {
+		return n, errors.Errorf("shard cannot be used with struct keys or nestedkeys")
+	}
+	if err := n.AnalyseElemNode(n, c); err != nil {
+		return n, errors.Wrap(err, "analysing map element node")
+	}
+	// Sets nested in this map's directory store their own members as markers.
+	if _, nested := (*n.ElemNode).(*MapNode); n.Field != nil && n.Field.Tag.Marker &&
+		!n.markers() && !nested {
+		return n, errors.Errorf("marker needs bool or struct{} elements; element type is %s", n.Type.Elem())
+	}
+	if n.nestedKeys() && isDirCollection(*n.ElemNode) {
+		return n, errors.Errorf("nestedkeys cannot be used with elements stored in directories of their own; element type is %s", n.Type.Elem())
+	}
+	if in, ok := (*n.ElemNode).(*InterfaceNode); ok && in.TypeSuffix && n.nestedKeys() {
+		return n, errors.Errorf("nestedkeys cannot be used with typesuffix")
+	}
+	return n, nil
+}
+
+// analyseKeySegments sets KeySegments if KeyType is a struct, checking that
+// each key field can be written as a path segment.
+func (n *MapNode) analyseKeySegments() error {
+	if n.KeyType.Kind() != reflect.Struct {
+		return checkKeyKind(n.KeyType)
+	}
+	var names []string
+	if n.Field != nil && n.Field.Tag.KeyOrder != "" {
+		names = strings.Split(n.Field.Tag.KeyOrder, "/")
+	} else {
+		for i := 0; i < n.KeyType.NumField(); i++ {
+			names = append(names, n.KeyType.Field(i).Name)
+		}
+	}
+	if len(names) == 0 {
+		return errors.Errorf("struct key has no fields")
+	}
+	seen := map[string]bool{}
+	for _, name := range names {
+		f, ok := n.KeyType.FieldByName(name)
+		if !ok {
+			return errors.Errorf("no field %q", name)
+		}
+		if f.PkgPath != "" {
+			return errors.Errorf("field %s is unexported", name)
+		}
+		if seen[name] {
+			return errors.Errorf("field %s appears more than once", name)
+		}
+		seen[name] = true
+		if err := checkKeyKind(f.Type); err != nil {
+			return errors.Wrapf(err, "field %s", name)
+		}
+	}
+	if len(seen) != n.KeyType.NumField() {
+		return errors.Errorf("key order %q must list all %d fields",
+			n.Field.Tag.KeyOrder, n.KeyType.NumField())
+	}
+	n.KeySegments = names
+	return nil
+}
+
+// checkKeyKind returns an error if values of t cannot be parsed from a path
+// segment.
+func checkKeyKind(t reflect.Type) error {
+	switch t.Kind() {
+	default:
+		return errors.Errorf("kind %s not supported", t.Kind())
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return nil
+	}
+}
+
+// parseKey parses s as a value of type t.
+func parseKey(s string, t reflect.Type) (reflect.Value, error) {
+	v := reflect.New(t).Elem()
+	var err error
+	switch t.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		var b bool
+		b, err = strconv.ParseBool(s)
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		i, err = strconv.ParseInt(s, 10, t.Bits())
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var u uint64
+		u, err = strconv.ParseUint(s, 10, t.Bits())
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		f, err = strconv.ParseFloat(s, t.Bits())
+		v.SetFloat(f)
+	}
+	return v, errors.Wrapf(err, "parsing %q as %s", s, t)
 }
 
 // ChildPathName returns the key as a string.
 func (n *MapNode) ChildPathName(child Node, key, val reflect.Value) string {
-	//if n.Field != nil && n.Field.KeyField != "" {
-	//	n.Field.GetKeyFunc.Call([]reflect.Value{val})
-	//}
-	return fmt.Sprint(key)
+	p, _ := n.keyPath(key)
+	return p
+}
+
+// nestedKeys returns true if "/" in keys separates directories.
+func (n *MapNode) nestedKeys() bool {
+	return n.Field != nil && n.Field.Tag.NestedKeys
+}
+
+// sharded returns true if elements are stored in shard directories.
+func (n *MapNode) sharded() bool {
+	return n.Field != nil && n.Field.Tag.Shard != 0
+}
+
+// shard returns the name of the shard directory for the key s. It is the
+// start of s, or of the hex SHA-1 hash of s with the shardhash option, or
+// all of s if it is shorter than the shard length.
+func (n *MapNode) shard(s string) string {
+	if n.Field.Tag.ShardHash {
+		s = fmt.Sprintf("%x", sha1.Sum([]byte(s)))
+	}
+	if r := []rune(s); len(r) > n.Field.Tag.Shard {
+		return string(r[:n.Field.Tag.Shard])
+	}
+	return s
+}
+
+// markers returns true if this map is a set, whose members are stored as
+// marker files.
+func (n *MapNode) markers() bool {
+	if n.Field == nil || !n.Field.Tag.Marker {
+		return false
+	}
+	t := n.Type.Elem()
+	return t.Kind() == reflect.Bool || t.Kind() == reflect.Struct && t.NumField() == 0
+}
+
+// keyPath returns the path of the element at key, relative to this map's
+// directory. Struct keys have a path segment for each field, and nested keys
+// have a path segment for each part separated by "/".
+func (n *MapNode) keyPath(key reflect.Value) (string, error) {
+	if n.KeySegments == nil {
+		s := fmt.Sprint(key)
+		if n.nestedKeys() {
+			for _, segment := range strings.Split(s, "/") {
+				if !isPathSegment(segment) {
+					return "", errors.Errorf("key %q is not a valid path", s)
+				}
+			}
+			return s, nil
+		}
+		if !isPathSegment(s) {
+			return "", errors.Errorf("key %q is not a valid path segment", s)
+		}
+		if n.sharded() {
+			shard := n.shard(s)
+			if !isPathSegment(shard) {
+				return "", errors.Errorf("key %q has shard %q, which is not a valid path segment", s, shard)
+			}
+			return path.Join(shard, s), nil
+		}
+		return s, nil
+	}
+	segments := make([]string, len(n.KeySegments))
+	for i, name := range n.KeySegments {
+		s := fmt.Sprint(key.FieldByName(name))
+		if !isPathSegment(s) {
+			return "", errors.Errorf("key field %s value %q is not a valid path segment", name, s)
+		}
+		segments[i] = s
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// isPathSegment returns true if s is usable as a single path segment.
+func isPathSegment(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.Contains(s, "/")
 }
 
 // ReadTargets reads targets into map entries.
 func (n *MapNode) ReadTargets(c ReadContext, key reflect.Value) (reflect.Value, error) {
 	val := reflect.MakeMap(n.Type)
-	list := c.List()
-	for _, keyStr := range list {
-		elemKey := reflect.ValueOf(keyStr)
-		elem := *n.ElemNode
-		elemContext := c.Push(keyStr)
-		elemVal, err := elem.Read(elemContext, elemKey)
+	if n.KeySegments != nil {
+		return val, n.readSegments(c, val, nil)
+	}
+	if n.nestedKeys() {
+		return val, n.readNestedKeys(c, val, "")
+	}
+	if n.sharded() {
+		return val, n.readShards(c, val)
+	}
+	for _, keyStr := range n.List(c) {
+		elemKey, err := parseKey(keyStr, n.KeyType)
 		if err != nil {
+			return val, errors.Wrapf(err, "reading key")
+		}
+		if err := n.readElem(c.Push(keyStr), val, elemKey); err != nil {
 			return val, errors.Wrapf(err, "reading child %s", keyStr)
 		}
-		val.SetMapIndex(elemKey, elemVal)
 	}
 	return val, nil
 }
 
+// readShards reads the elements in each shard directory into val. Elements
+// in the wrong shard are an error, since they would be written elsewhere.
+func (n *MapNode) readShards(c ReadContext, val reflect.Value) error {
+	for _, shard := range n.exclude(c.List()) {
+		shardContext := c.Push(shard)
+		for _, keyStr := range trimTypeSuffixes(*n.ElemNode, shardContext.List()) {
+			if s := n.shard(keyStr); s != shard {
+				return errors.Errorf("key %q is in shard %q; want %q", keyStr, shard, s)
+			}
+			elemKey, err := parseKey(keyStr, n.KeyType)
+			if err != nil {
+				return errors.Wrapf(err, "reading key")
+			}
+			if err := n.readElem(shardContext.Push(keyStr), val, elemKey); err != nil {
+				return errors.Wrapf(err, "reading child %s", keyStr)
+			}
+		}
+	}
+	return nil
+}
+
+// readSegments reads the elements of a map with a struct key, whose
+// segments so far are segments, into val.
+func (n *MapNode) readSegments(c ReadContext, val reflect.Value, segments []string) error {
+	if len(segments) == len(n.KeySegments) {
+		elemKey := reflect.New(n.KeyType).Elem()
+		for i, name := range n.KeySegments {
+			f := elemKey.FieldByName(name)
+			v, err := parseKey(segments[i], f.Type())
+			if err != nil {
+				return errors.Wrapf(err, "reading key field %s", name)
+			}
+			f.Set(v)
+		}
+		return errors.Wrapf(n.readElem(c, val, elemKey),
+			"reading child %s", strings.Join(segments, "/"))
+	}
+	list := c.List()
+	if len(segments) == 0 {
+		list = n.List(c)
+	} else if len(segments) == len(n.KeySegments)-1 {
+		list = trimTypeSuffixes(*n.ElemNode, list)
+	}
+	for _, s := range list {
+		if err := n.readSegments(c.Push(s), val, append(segments, s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readNestedKeys reads the elements of a map with nested keys beginning with
+// keyPrefix into val. Each file is an element, and each directory without a
+// file of the same name, or its own file, contains more elements.
+func (n *MapNode) readNestedKeys(c ReadContext, val reflect.Value, keyPrefix string) error {
+	list := c.List()
+	if keyPrefix == "" {
+		list = n.List(c)
+	}
+	for _, s := range list {
+		keyStr := path.Join(keyPrefix, s)
+		elemContext := c.Push(s)
+		if !elemContext.IsFile() && !elemContext.IsDirFile() {
+			if err := n.readNestedKeys(elemContext, val, keyStr); err != nil {
+				return err
+			}
+			continue
+		}
+		elemKey := reflect.ValueOf(keyStr).Convert(n.KeyType)
+		if err := n.readElem(elemContext, val, elemKey); err != nil {
+			return errors.Wrapf(err, "reading child %s", keyStr)
+		}
+	}
+	return nil
+}
+
+// readElem reads the element at c into val at key. If this map is a set, the
+// element is a member, so it is true, or an empty struct.
+func (n *MapNode) readElem(c ReadContext, val, key reflect.Value) error {
+	if n.markers() {
+		member := reflect.New(n.Type.Elem()).Elem()
+		if member.Kind() == reflect.Bool {
+			member.SetBool(true)
+		}
+		val.SetMapIndex(key, member)
+		return nil
+	}
+	elemVal, err := (*n.ElemNode).Read(c, key)
+	if err != nil {
+		return err
+	}
+	val.SetMapIndex(key, n.SetElemKey(elemVal, key))
+	return nil
+}
+
 // WriteTargets writes all map elements.
 func (n *MapNode) WriteTargets(c WriteContext, key, val reflect.Value) error {
+	if !val.IsValid() {
+		// A nil pointer to a map or slice has no elements.
+		return nil
+	}
+	if n.nestedKeys() {
+		if err := checkNestedKeys(val); err != nil {
+			return err
+		}
+	}
 	elemNode := *n.ElemNode
 	for _, k := range val.MapKeys() {
-		v := val.MapIndex(k)
-		// make an addressable copy of v
-		// this is ripe for refactoring so we don't need to jump through hoops
-		// to get the address.
-		newVal := reflect.New(v.Type()).Elem()
-		newVal.Set(v)
-		v = newVal
-		vAddr := v
-		if vAddr.Kind() != reflect.Ptr {
-			vAddr = v.Addr()
-		}
-		if n.Field != nil && n.Field.KeyField != "" {
-			n.Field.SetKeyFunc.Call([]reflect.Value{vAddr, k})
-		}
+		v := n.SetElemKey(val.MapIndex(k), k)
 		//log.Printf("Writing %s[%s] = %+ v\n", n.Type, k, v)
-		childContext := c.Push(elemNode.PathName(k, v))
+		p, err := n.keyPath(k)
+		if err == nil {
+			err = n.checkElemPath(p)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "writing map index %q failed", fmt.Sprint(k))
+		}
+		childContext := c.Push(p)
+		if n.markers() {
+			// Only members of the set are written; false is not a member.
+			if v.Kind() != reflect.Bool || v.Bool() {
+				if err := childContext.SetValue(MarkerFile{}); err != nil {
+					return errors.Wrapf(err, "writing map index %q failed", fmt.Sprint(k))
+				}
+			}
+			continue
+		}
 		if err := elemNode.Write(childContext, k, v); err != nil {
 			return errors.Wrapf(err, "writing map index %q failed", fmt.Sprint(k))
 		}
 	}
 	return nil
 }
+
+// checkNestedKeys returns an error if any key of the nested key map val is a
+// directory of another key, since they could not be told apart when read.
+func checkNestedKeys(val reflect.Value) error {
+	keys := make(map[string]bool, val.Len())
+	for _, k := range val.MapKeys() {
+		keys[k.String()] = true
+	}
+	for k := range keys {
+		for dir := path.Dir(k); dir != "."; dir = path.Dir(dir) {
+			if keys[dir] {
+				return errors.Errorf("key %q is a directory of key %q", dir, k)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,549 @@
+package hy
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type (
+	DeployKey struct {
+		Region, Service string
+	}
+	VersionKey struct {
+		Major, Minor int
+		Name         string
+	}
+	CompositeKeyStruct struct {
+		Deploys  map[DeployKey]StructB       `hy:"deploys/"`
+		Versions map[VersionKey]StructB      `hy:"versions/,keyorder=Name/Major/Minor"`
+		IntKeys  map[int]StructB             `hy:"int-keys/"`
+		PtrElems map[DeployKey]*StructB      `hy:"ptr-elems/"`
+		Nested   map[DeployKey]CompositeElem `hy:"nested/"`
+	}
+	CompositeElem struct {
+		Name  string
+		Child StructB `hy:"child"`
+	}
+)
+
+func TestMapNode_compositeKeys(t *testing.T) {
+	in := CompositeKeyStruct{
+		Deploys: map[DeployKey]StructB{
+			{"eu-west", "api"}: {Name: "eu api"},
+			{"eu-west", "web"}: {Name: "eu web"},
+			{"us-east", "api"}: {Name: "us api"},
+		},
+		Versions: map[VersionKey]StructB{
+			{1, 2, "thing"}: {Name: "thing 1.2"},
+		},
+		IntKeys:  map[int]StructB{1: {Name: "one"}, 20: {Name: "twenty"}},
+		PtrElems: map[DeployKey]*StructB{{"eu-west", "api"}: {Name: "ptr"}},
+		Nested: map[DeployKey]CompositeElem{
+			{"eu-west", "api"}: {Name: "nested", Child: StructB{Name: "child"}},
+		},
+	}
+	var out CompositeKeyStruct
+	prefix := roundTrip(t, newTestCodec(), "map-composite-keys", in, &out)
+
+	expectedFiles := map[string]string{
+		"deploys/eu-west/api":      `{"Name":"eu api"}`,
+		"deploys/us-east/api":      `{"Name":"us api"}`,
+		"versions/thing/1/2":       `{"Name":"thing 1.2"}`,
+		"int-keys/20":              `{"Name":"twenty"}`,
+		"nested/eu-west/api/child": `{"Name":"child"}`,
+	}
+	for path, expected := range expectedFiles {
+		if actual := readTestFile(t, prefix, path); actual != expected {
+			t.Errorf("got %s at %q; want %s", actual, path, expected)
+		}
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got %+v; want %+v", out, in)
+	}
+}
+
+func TestMapNode_compositeKeys_failure(t *testing.T) {
+	type (
+		badKeyField struct{ Key struct{ A string } }
+		badKeyOrder struct {
+			Map map[DeployKey]StructB `hy:"map/,keyorder=Region"`
+		}
+		badKeyMap struct {
+			Map map[badKeyField]StructB `hy:"map/"`
+		}
+	)
+	c := NewCodec()
+	for expected, input := range map[string]interface{}{
+		`key order "Region" must list all 2 fields`: badKeyOrder{},
+		`field Key: kind struct not supported`:      badKeyMap{},
+	} {
+		_, err := c.Analyse(input)
+		if err == nil {
+			t.Errorf("got nil error analysing %T; want error containing %q", input, expected)
+			continue
+		}
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("got error %q; want it to contain %q", err, expected)
+		}
+	}
+	in := CompositeKeyStruct{
+		Deploys: map[DeployKey]StructB{{"eu/west", "api"}: {}},
+	}
+	err := c.Write(filepath.Join(t.TempDir(), "map-composite-keys-failure"), in)
+	expected := `key field Region value "eu/west" is not a valid path segment`
+	if err == nil || !strings.Contains(err.Error(), expected) {
+		t.Errorf("got error %v; want it to contain %q", err, expected)
+	}
+}
+
+type NestedKeysStruct struct {
+	Templates map[string]StructB `hy:"templates/,Name,nestedkeys"`
+}
+
+func TestMapNode_nestedKeys(t *testing.T) {
+	in := NestedKeysStruct{
+		Templates: map[string]StructB{
+			"email/welcome/en": {Name: "email/welcome/en"},
+			"email/welcome/fr": {Name: "email/welcome/fr"},
+			"email/goodbye":    {Name: "email/goodbye"},
+			"sms":              {Name: "sms"},
+		},
+	}
+	var out NestedKeysStruct
+	prefix := roundTrip(t, newTestCodec(), "map-nested-keys", in, &out)
+	for _, path := range []string{"templates/email/welcome/en", "templates/sms"} {
+		if actual := readTestFile(t, prefix, path); actual != `{}` {
+			t.Errorf("got %s at %q; want {}", actual, path)
+		}
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got %+v; want %+v", out, in)
+	}
+}
+
+func TestMapNode_nestedKeys_failure(t *testing.T) {
+	c := NewCodec()
+	for expected, input := range map[string]interface{}{
+		`key "email" is a directory of key "email/welcome"`: NestedKeysStruct{
+			Templates: map[string]StructB{"email": {}, "email/welcome": {}},
+		},
+		`key "email//welcome" is not a valid path`: NestedKeysStruct{
+			Templates: map[string]StructB{"email//welcome": {}},
+		},
+		`key "email/welcome" is not a valid path segment`: TestWriteStruct{
+			Map: map[string]StructB{"email/welcome": {}},
+		},
+	} {
+		err := c.Write(filepath.Join(t.TempDir(), "map-nested-keys-failure"), input)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("got error %v; want it to contain %q", err, expected)
+		}
+	}
+}
+
+type NestedCollectionStruct struct {
+	MapOfMaps     map[string]map[string]StructB  `hy:"envs/"`
+	SliceOfMaps   []map[string]StructB           `hy:"slice-of-maps/"`
+	MapOfSlices   map[string][]*StructB          `hy:"map-of-slices/"`
+	MapOfPtrMaps  map[string]*map[string]StructB `hy:"map-of-ptr-maps/"`
+	DepthOne      map[string]map[string]StructB  `hy:"depth-one/,depth=1"`
+	DepthTwo      map[string][]map[int]string    `hy:"depth-two/,depth=2"`
+	UnlimitedDeep map[string][]map[int]string    `hy:"unlimited/"`
+	NestedGaps    [][]int                        `hy:"nested-gaps/,gaps=zero"`
+	NestedShards  map[string]map[string]string   `hy:"nested-shards/,shard=1"`
+}
+
+func TestMapNode_nestedCollections(t *testing.T) {
+	in := NestedCollectionStruct{
+		MapOfMaps: map[string]map[string]StructB{
+			"prod":    {"api": {Name: "prod api"}, "web": {Name: "prod web"}},
+			"staging": {"api": {Name: "staging api"}},
+		},
+		SliceOfMaps: []map[string]StructB{
+			{"a": {Name: "0a"}}, {"b": {Name: "1b"}},
+		},
+		MapOfSlices: map[string][]*StructB{
+			"x": {{Name: "x0"}, {Name: "x1"}},
+		},
+		MapOfPtrMaps: map[string]*map[string]StructB{
+			"p": {"q": {Name: "pq"}},
+		},
+		DepthOne: map[string]map[string]StructB{
+			"prod": {"api": {Name: "prod api"}},
+		},
+		DepthTwo: map[string][]map[int]string{
+			"a": {{1: "one"}},
+		},
+		UnlimitedDeep: map[string][]map[int]string{
+			"a": {{1: "one"}},
+		},
+		NestedGaps:   [][]int{{1, 2, 3}},
+		NestedShards: map[string]map[string]string{"eu": {"api": "eu api"}},
+	}
+	var out NestedCollectionStruct
+	prefix := roundTrip(t, newTestCodec(), "map-nested-collections", in, &out)
+
+	expectedFiles := map[string]string{
+		"envs/prod/api":       `{"Name":"prod api"}`,
+		"envs/staging/api":    `{"Name":"staging api"}`,
+		"slice-of-maps/1/b":   `{"Name":"1b"}`,
+		"map-of-slices/x/1":   `{"Name":"x1"}`,
+		"map-of-ptr-maps/p/q": `{"Name":"pq"}`,
+		"depth-one/prod":      `{"api":{"DirSubMap":null,"FileSubStruct":null,"Name":"prod api"}}`,
+		"depth-two/a/0":       `{"1":"one"}`,
+		"unlimited/a/0/1":     `"one"`,
+		// Options apply at every nested level.
+		"nested-shards/e/eu/a/api": `"eu api"`,
+	}
+	for path, expected := range expectedFiles {
+		if actual := readTestFile(t, prefix, path); actual != expected {
+			t.Errorf("got %s at %q; want %s", actual, path, expected)
+		}
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got %+v; want %+v", out, in)
+	}
+
+	if err := os.Remove(filepath.Join(prefix, "nested-gaps/0/1.json")); err != nil {
+		t.Fatal(err)
+	}
+	out = NestedCollectionStruct{}
+	if err := newTestCodec().Read(prefix, &out); err != nil {
+		t.Fatal(err)
+	}
+	if expected := [][]int{{1, 0, 3}}; !reflect.DeepEqual(out.NestedGaps, expected) {
+		t.Errorf("got %v; want %v", out.NestedGaps, expected)
+	}
+}
+
+func TestMapNode_nestedCollections_failure(t *testing.T) {
+	type nestedKeysDirs struct {
+		Map map[string]map[string]string `hy:"m/,nestedkeys"`
+	}
+	_, err := NewCodec().Analyse(nestedKeysDirs{})
+	if expected := "nestedkeys cannot be used with elements stored in directories of their own"; err == nil ||
+		!strings.Contains(err.Error(), expected) {
+		t.Errorf("got error %v; want it to contain %q", err, expected)
+	}
+}
+
+type (
+	ElemDirsStruct struct {
+		Map    map[string]ElemDirsElem    `hy:"map/,Name,elemdirs"`
+		Slice  []*ElemDirsElem            `hy:"slice/,elemdirs"`
+		Nested map[string]map[int]StructB `hy:"nested/,elemdirs"`
+		Keys   map[string]ElemDirsElem    `hy:"keys/,nestedkeys,elemdirs"`
+	}
+	ElemDirsElem struct {
+		Name  string
+		Value int
+		Child StructB           `hy:"child"`
+		Map   map[string]string `hy:"map/"`
+	}
+)
+
+func TestMapNode_elemDirs(t *testing.T) {
+	first := ElemDirsElem{
+		Name:  "First",
+		Value: 1,
+		Child: StructB{Name: "child"},
+		Map:   map[string]string{"a": "b"},
+	}
+	in := ElemDirsStruct{
+		Map:    map[string]ElemDirsElem{"First": first},
+		Slice:  []*ElemDirsElem{&first},
+		Nested: map[string]map[int]StructB{"a": {1: {Name: "a1"}}},
+		Keys:   map[string]ElemDirsElem{"x/y": first},
+	}
+	var out ElemDirsStruct
+	prefix := roundTrip(t, newTestCodec(), "map-elem-dirs", in, &out)
+
+	expectedFiles := map[string]string{
+		"map/First/_":     `{"Value":1}`,
+		"map/First/child": `{"Name":"child"}`,
+		"map/First/map/a": `"b"`,
+		"slice/0/_":       `{"Name":"First","Value":1}`,
+		"slice/0/child":   `{"Name":"child"}`,
+		"nested/a/1/_":    `{"Name":"a1"}`,
+		"keys/x/y/_":      `{"Name":"First","Value":1}`,
+	}
+	for path, expected := range expectedFiles {
+		if actual := readTestFile(t, prefix, path); actual != expected {
+			t.Errorf("got %s at %q; want %s", actual, path, expected)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(prefix, "map", "First.json")); !os.IsNotExist(err) {
+		t.Errorf("got %v; want map/First.json not to exist", err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got %+v; want %+v", out, in)
+	}
+}
+
+func TestMapNode_elemDirs_failure(t *testing.T) {
+	type badElemDirs struct {
+		Map map[string]string `hy:"map/,elemdirs"`
+	}
+	_, err := NewCodec().Analyse(badElemDirs{})
+	expected := "elemdirs needs struct elements"
+	if err == nil || !strings.Contains(err.Error(), expected) {
+		t.Errorf("got error %v; want it to contain %q", err, expected)
+	}
+}
+
+type (
+	EntriesServices struct {
+		Description string
+		Defaults    StructB            `hy:"defaults"`
+		Entries     map[string]StructB `hy:",Name,entries"`
+	}
+	EntriesSlice struct {
+		Order   []string
+		Entries []StructB `hy:",entries"`
+	}
+	DirServices struct {
+		Description string
+		Defaults    StructB `hy:"defaults"`
+	}
+	EntriesStruct struct {
+		Services EntriesServices `hy:"services/"`
+		Plain    EntriesServices `hy:"plain"`
+		Slice    *EntriesSlice   `hy:"slice/"`
+		Dir      DirServices     `hy:"dir/"`
+	}
+)
+
+func TestMapNode_entries(t *testing.T) {
+	services := EntriesServices{
+		Description: "Some services.",
+		Defaults:    StructB{Name: "default"},
+		Entries: map[string]StructB{
+			"api": {Name: "api"},
+			"web": {Name: "web"},
+		},
+	}
+	in := EntriesStruct{
+		Services: services,
+		Plain:    services,
+		Slice: &EntriesSlice{
+			Order:   []string{"b", "a"},
+			Entries: []StructB{{Name: "zero"}, {Name: "one"}},
+		},
+		Dir: DirServices{Description: "No entries.", Defaults: StructB{Name: "default"}},
+	}
+	var out EntriesStruct
+	prefix := roundTrip(t, newTestCodec(), "map-entries", in, &out)
+
+	expectedFiles := map[string]string{
+		"services/_":        `{"Description":"Some services."}`,
+		"services/defaults": `{"Name":"default"}`,
+		"services/api":      `{}`,
+		"plain":             `{"Description":"Some services."}`,
+		"plain/defaults":    `{"Name":"default"}`,
+		"plain/web":         `{}`,
+		"slice/_":           `{"Order":["b","a"]}`,
+		"slice/1":           `{"Name":"one"}`,
+		// Structs without entries are stored next to their directories.
+		"dir":          `{"Description":"No entries."}`,
+		"dir/defaults": `{"Name":"default"}`,
+	}
+	for path, expected := range expectedFiles {
+		if actual := readTestFile(t, prefix, path); actual != expected {
+			t.Errorf("got %s at %q; want %s", actual, path, expected)
+		}
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got %+v; want %+v", out, in)
+	}
+
+	var root EntriesServices
+	roundTrip(t, newTestCodec(), "map-entries-root", services, &root)
+	if !reflect.DeepEqual(root, services) {
+		t.Errorf("got %+v; want %+v", root, services)
+	}
+}
+
+func TestMapNode_rootFileNameKey_failure(t *testing.T) {
+	type rootFileNameKeys struct {
+		Map    map[string]StructB            `hy:"map/"`
+		Nested map[string]map[string]StructB `hy:"nested/"`
+	}
+	for _, in := range []interface{}{
+		rootFileNameKeys{Map: map[string]StructB{"_": {}}},
+		rootFileNameKeys{Nested: map[string]map[string]StructB{"a": {"_": {}}}},
+		map[string]StructB{"_": {}},
+	} {
+		err := newTestCodec().Write(filepath.Join(t.TempDir(), "map-root-file-name-failure"), in)
+		if expected := "is reserved for the file of directory"; err == nil ||
+			!strings.Contains(err.Error(), expected) {
+			t.Errorf("got error %v writing %+v; want it to contain %q", err, in, expected)
+		}
+	}
+}
+
+func TestMapNode_entries_failure(t *testing.T) {
+	in := EntriesServices{Entries: map[string]StructB{"defaults": {}}}
+	err := NewCodec().Write(filepath.Join(t.TempDir(), "map-entries-failure"), in)
+	expected := `element path "defaults" collides with another field`
+	if err == nil || !strings.Contains(err.Error(), expected) {
+		t.Errorf("got error %v; want it to contain %q", err, expected)
+	}
+}
+
+type ShardStruct struct {
+	Users  map[string]StructB `hy:"users/,Name,shard=2"`
+	Hashed map[string]string  `hy:"hashed/,shard=2,shardhash"`
+	Ints   map[int]string     `hy:"ints/,shard=1"`
+}
+
+func TestMapNode_shards(t *testing.T) {
+	in := ShardStruct{
+		Users: map[string]StructB{
+			"abcdef": {Name: "abcdef"}, "abxyz": {Name: "abxyz"}, "c": {Name: "c"},
+			".a": {Name: ".a"},
+		},
+		Hashed: map[string]string{"abcdef": "abcdef", "c": "c"},
+		Ints:   map[int]string{12: "twelve", 3: "three"},
+	}
+	var out ShardStruct
+	prefix := roundTrip(t, newTestCodec(), "map-shards", in, &out)
+
+	expectedFiles := map[string]string{
+		"users/ab/abcdef":  `{}`,
+		"users/ab/abxyz":   `{}`,
+		"users/c/c":        `{}`,
+		"users/.a/.a":      `{}`,
+		"hashed/1f/abcdef": `"abcdef"`,
+		"hashed/84/c":      `"c"`,
+		"ints/1/12":        `"twelve"`,
+		"ints/3/3":         `"three"`,
+	}
+	for path, expected := range expectedFiles {
+		if actual := readTestFile(t, prefix, path); actual != expected {
+			t.Errorf("got %s at %q; want %s", actual, path, expected)
+		}
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got %+v; want %+v", out, in)
+	}
+
+	// Elements in the wrong shard are not read.
+	if err := os.Rename(filepath.Join(prefix, "users/c/c.json"),
+		filepath.Join(prefix, "users/ab/c.json")); err != nil {
+		t.Fatal(err)
+	}
+	err := newTestCodec().Read(prefix, &ShardStruct{})
+	if expected := `key "c" is in shard "ab"; want "c"`; err == nil ||
+		!strings.Contains(err.Error(), expected) {
+		t.Errorf("got error %v; want it to contain %q", err, expected)
+	}
+}
+
+func TestMapNode_shards_failure(t *testing.T) {
+	type (
+		shardNestedKeys struct {
+			Map map[string]string `hy:"map/,nestedkeys,shard=2"`
+		}
+		shardStructKeys struct {
+			Map map[DeployKey]string `hy:"map/,shard=2"`
+		}
+	)
+	c := NewCodec()
+	for _, input := range []interface{}{shardNestedKeys{}, shardStructKeys{}} {
+		_, err := c.Analyse(input)
+		if expected := "shard cannot be used with struct keys or nestedkeys"; err == nil ||
+			!strings.Contains(err.Error(), expected) {
+			t.Errorf("got error %v for %T; want it to contain %q", err, input, expected)
+		}
+	}
+
+	prefix := filepath.Join(t.TempDir(), "map-shards-failure")
+	err := c.Write(prefix, ShardStruct{Users: map[string]StructB{"..x": {Name: "..x"}}})
+	if expected := `key "..x" has shard "..", which is not a valid path segment`; err == nil ||
+		!strings.Contains(err.Error(), expected) {
+		t.Errorf("got error %v; want it to contain %q", err, expected)
+	}
+	if _, err := os.Stat(filepath.Join(prefix, "..x.json")); !os.IsNotExist(err) {
+		t.Errorf("got error %v checking for file outside map; want not exist", err)
+	}
+}
+
+type (
+	SplitService struct {
+		Config  StructB  `hy:"config"`
+		Secrets *StructB `hy:"secrets"`
+	}
+	SplitNamed struct {
+		Name   string
+		Config StructB `hy:"config"`
+	}
+	SplitStruct struct {
+		Map    map[string]SplitService             `hy:"svc/"`
+		Ptrs   map[string]*SplitService            `hy:"ptrs/"`
+		Nested map[string]map[string]*SplitService `hy:"nested/"`
+		Slice  []*SplitService                     `hy:"slice/"`
+		Dirs   map[string]*SplitService            `hy:"dirs/,elemdirs"`
+		Named  map[string]*SplitNamed              `hy:"named/,Name"`
+		Zeros  []SplitService                      `hy:"zeros/"`
+		Keys   map[string]*SplitService            `hy:"keys/,nestedkeys"`
+	}
+)
+
+func TestMapNode_splitElems(t *testing.T) {
+	api := SplitService{Config: StructB{Name: "config"}, Secrets: &StructB{Name: "secrets"}}
+	in := SplitStruct{
+		Map:    map[string]SplitService{"api": api, "empty": {}},
+		Ptrs:   map[string]*SplitService{"api": &api, "nil": nil, "zero": {}},
+		Nested: map[string]map[string]*SplitService{"eu": {"api": &api, "nil": nil}},
+		Slice:  []*SplitService{&api, nil},
+		Dirs:   map[string]*SplitService{"api": &api, "nil": nil},
+		Named: map[string]*SplitNamed{
+			"api": {Name: "api", Config: StructB{Name: "config"}}, "nil": nil,
+		},
+		// A zero element at index 0 keeps later elements at their indices.
+		Zeros: []SplitService{{}, api},
+		Keys:  map[string]*SplitService{"email/api": &api},
+	}
+	var out SplitStruct
+	prefix := roundTrip(t, newTestCodec(), "map-split-elems", in, &out)
+
+	// Elements have their own files even with no untagged fields, so that
+	// zero elements keep their keys.
+	expectedFiles := map[string]string{
+		"svc/api":               `{}`,
+		"svc/api/config":        `{"Name":"config"}`,
+		"svc/api/secrets":       `{"Name":"secrets"}`,
+		"svc/empty":             `{}`,
+		"ptrs/api":              `{}`,
+		"ptrs/api/secrets":      `{"Name":"secrets"}`,
+		"ptrs/nil":              `null`,
+		"ptrs/zero":             `{}`,
+		"nested/eu/api":         `{}`,
+		"nested/eu/api/secrets": `{"Name":"secrets"}`,
+		"nested/eu/nil":         `null`,
+		"slice/0":               `{}`,
+		"slice/0/config":        `{"Name":"config"}`,
+		"slice/1":               `null`,
+		"dirs/api/_":            `{}`,
+		"dirs/api/config":       `{"Name":"config"}`,
+		"dirs/nil":              `null`,
+		"named/api":             `{}`,
+		"named/api/config":      `{"Name":"config"}`,
+		"named/nil":             `null`,
+		"zeros/0":               `{}`,
+		"zeros/1/config":        `{"Name":"config"}`,
+		"keys/email/api":        `{}`,
+		"keys/email/api/config": `{"Name":"config"}`,
+	}
+	for path, expected := range expectedFiles {
+		if actual := readTestFile(t, prefix, path); actual != expected {
+			t.Errorf("got %s at %q; want %s", actual, path, expected)
+		}
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got %+v; want %+v", out, in)
+	}
+}
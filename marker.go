@@ -0,0 +1,36 @@
+package hy
+
+import (
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// A MarkerNode represents a bool field stored as the presence of an empty
+// marker file, which exists only if the field is true.
+type MarkerNode struct {
+	NodeBase
+}
+
+// NewMarkerNode creates a new marker node.
+func NewMarkerNode(base NodeBase) Node {
+	return &MarkerNode{NodeBase: base}
+}
+
+// ChildPathName returns an empty string (marker files don't have children).
+func (n *MarkerNode) ChildPathName(child Node, key, val reflect.Value) string {
+	return ""
+}
+
+// ReadTargets returns true if the marker file exists.
+func (n *MarkerNode) ReadTargets(c ReadContext, key reflect.Value) (reflect.Value, error) {
+	return reflect.ValueOf(c.IsFile()).Convert(n.Type), nil
+}
+
+// WriteTargets writes the marker file if val is true.
+func (n *MarkerNode) WriteTargets(c WriteContext, key, val reflect.Value) error {
+	if !val.Bool() {
+		return nil
+	}
+	return errors.Wrap(c.SetValue(MarkerFile{}), "writing marker file")
+}
@@ -0,0 +1,113 @@
+package hy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type MarkerStruct struct {
+	Enabled  bool                `hy:"enabled,marker"`
+	Disabled bool                `hy:"disabled,marker"`
+	Features map[string]struct{} `hy:"features/,marker"`
+	Flags    map[string]bool     `hy:"flags/,marker"`
+	// Sets nested in a map store their members as markers.
+	Nested map[string]map[string]bool `hy:"nested/,marker"`
+}
+
+func TestMarkerNode(t *testing.T) {
+	in := MarkerStruct{
+		Enabled:  true,
+		Features: map[string]struct{}{"beta": {}, "dark-mode": {}},
+		Flags:    map[string]bool{"on": true, "off": false},
+		Nested:   map[string]map[string]bool{"a": {"c": true}},
+	}
+	var out MarkerStruct
+	prefix := roundTrip(t, newTestCodec(), "marker", in, &out)
+
+	for _, path := range []string{"enabled", "features/beta", "features/dark-mode", "flags/on", "nested/a/c"} {
+		b, err := ioutil.ReadFile(filepath.Join(prefix, path+".json"))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if len(b) != 0 {
+			t.Errorf("got %q at %q; want empty file", b, path)
+		}
+	}
+	for _, path := range []string{"disabled", "flags/off"} {
+		if _, err := os.Stat(filepath.Join(prefix, path+".json")); !os.IsNotExist(err) {
+			t.Errorf("got %v for %q; want not exist", err, path)
+		}
+	}
+	expected := in
+	expected.Flags = map[string]bool{"on": true}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("got %+v; want %+v", out, expected)
+	}
+
+	// Markers are toggled by creating and removing files.
+	for _, path := range []string{"disabled", "features/new", "flags/off"} {
+		if err := ioutil.WriteFile(filepath.Join(prefix, path+".json"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{"enabled", "features/beta"} {
+		if err := os.Remove(filepath.Join(prefix, path+".json")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out = MarkerStruct{}
+	if err := newTestCodec().Read(prefix, &out); err != nil {
+		t.Fatal(err)
+	}
+	expected = MarkerStruct{
+		Disabled: true,
+		Features: map[string]struct{}{"dark-mode": {}, "new": {}},
+		Flags:    map[string]bool{"on": true, "off": true},
+		Nested:   map[string]map[string]bool{"a": {"c": true}},
+	}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("got %+v; want %+v", out, expected)
+	}
+}
+
+func TestMarkerNode_failure(t *testing.T) {
+	type (
+		markerString struct {
+			Field string `hy:"field,marker"`
+		}
+		markerPtr struct {
+			Field *bool `hy:"field,marker"`
+		}
+		markerFileMap struct {
+			Map map[string]bool `hy:"map,marker"`
+		}
+		markerElems struct {
+			Map map[string]int `hy:"map/,marker"`
+		}
+		markerNestedSlices struct {
+			Map map[string][]bool `hy:"map/,marker"`
+		}
+	)
+	const notBoolOrMap = "marker needs a bool or a map stored in a directory"
+	c := NewCodec()
+	for _, test := range []struct {
+		input    interface{}
+		expected string
+	}{
+		{markerString{}, notBoolOrMap},
+		{markerPtr{}, notBoolOrMap},
+		{markerFileMap{}, notBoolOrMap},
+		{markerElems{}, "marker needs bool or struct{} elements; element type is int"},
+		{markerNestedSlices{}, "marker needs bool or struct{} elements; element type is []bool"},
+	} {
+		_, err := c.Analyse(test.input)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("got error %v for %T; want it to contain %q", err, test.input, test.expected)
+		}
+	}
+}
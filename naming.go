@@ -0,0 +1,112 @@
+package hy
+
+import (
+	"strings"
+	"unicode"
+)
+
+// A NamingConvention converts a Go field name to a path or field name.
+type NamingConvention func(fieldName string) string
+
+var (
+	// CamelCase names fields like "CamelCase".
+	CamelCase NamingConvention = camelCase
+	// LowerCamelCase names fields like "lowerCamelCase".
+	LowerCamelCase NamingConvention = lowerCamelCase
+	// SnakeCase names fields like "snake_case".
+	SnakeCase NamingConvention = snakeCase
+	// KebabCase names fields like "kebab-case".
+	KebabCase NamingConvention = kebabCase
+	// LowerCase names fields like "lowercase".
+	LowerCase NamingConvention = lowerCase
+)
+
+// name returns the name of a field according to this convention. If nc is nil,
+// the field name is returned unchanged.
+func (nc NamingConvention) name(fieldName string) string {
+	if nc == nil {
+		return fieldName
+	}
+	return nc(fieldName)
+}
+
+func camelCase(s string) string {
+	words := splitWords(s)
+	for i, w := range words {
+		words[i] = upperFirst(w)
+	}
+	return strings.Join(words, "")
+}
+
+func lowerCamelCase(s string) string {
+	words := splitWords(s)
+	for i, w := range words {
+		if i == 0 {
+			words[i] = strings.ToLower(w)
+			continue
+		}
+		words[i] = upperFirst(w)
+	}
+	return strings.Join(words, "")
+}
+
+func snakeCase(s string) string {
+	return strings.ToLower(strings.Join(splitWords(s), "_"))
+}
+
+func kebabCase(s string) string {
+	return strings.ToLower(strings.Join(splitWords(s), "-"))
+}
+
+func lowerCase(s string) string {
+	return strings.ToLower(s)
+}
+
+func upperFirst(s string) string {
+	rs := []rune(s)
+	if len(rs) == 0 {
+		return s
+	}
+	rs[0] = unicode.ToUpper(rs[0])
+	return string(rs)
+}
+
+// splitWords splits a Go identifier into words. A new word begins at an upper
+// case letter following a lower case letter or digit, and at the last upper
+// case letter of an acronym followed by a lower case letter, so "HTTPServer2"
+// splits into "HTTP" and "Server2". A plural acronym like "IDs" is one word.
+// Underscores separate words and are dropped.
+func splitWords(s string) []string {
+	var words []string
+	rs := []rune(s)
+	start := 0
+	for i, r := range rs {
+		if r == '_' {
+			if i > start {
+				words = append(words, string(rs[start:i]))
+			}
+			start = i + 1
+			continue
+		}
+		if i == start || !unicode.IsUpper(r) {
+			continue
+		}
+		prev := rs[i-1]
+		nextIsLower := i+1 < len(rs) && unicode.IsLower(rs[i+1]) &&
+			!isPluralSuffix(rs[i+1:])
+		if unicode.IsLower(prev) || unicode.IsDigit(prev) ||
+			(unicode.IsUpper(prev) && nextIsLower) {
+			words = append(words, string(rs[start:i]))
+			start = i
+		}
+	}
+	if start < len(rs) {
+		words = append(words, string(rs[start:]))
+	}
+	return words
+}
+
+// isPluralSuffix returns true if rs begins with an "s" ending a word.
+func isPluralSuffix(rs []rune) bool {
+	return rs[0] == 's' && (len(rs) == 1 || !unicode.IsLower(rs[1]))
+}
@@ -0,0 +1,98 @@
+package hy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var namingConventionTable = map[string][]string{
+	//                  CamelCase, lowerCamelCase, snake_case, kebab-case, lowercase
+	"Name":           {"Name", "name", "name", "name", "name"},
+	"InlineMap":      {"InlineMap", "inlineMap", "inline_map", "inline-map", "inlinemap"},
+	"ID":             {"ID", "id", "id", "id", "id"},
+	"HTTPServer2":    {"HTTPServer2", "httpServer2", "http_server2", "http-server2", "httpserver2"},
+	"Server2HTTP":    {"Server2HTTP", "server2HTTP", "server2_http", "server2-http", "server2http"},
+	"Snake_Field":    {"SnakeField", "snakeField", "snake_field", "snake-field", "snake_field"},
+	"ServiceIDsByID": {"ServiceIDsByID", "serviceIDsByID", "service_ids_by_id", "service-ids-by-id", "serviceidsbyid"},
+}
+
+func TestNamingConvention(t *testing.T) {
+	conventions := []NamingConvention{CamelCase, LowerCamelCase, SnakeCase, KebabCase, LowerCase}
+	for input, expected := range namingConventionTable {
+		for i, nc := range conventions {
+			if actual := nc(input); actual != expected[i] {
+				t.Errorf("convention %d got %q from %q; want %q", i, actual, input, expected[i])
+			}
+		}
+	}
+}
+
+type (
+	NamingStruct struct {
+		InlineField string
+		JSONField   string             `json:"JSON_field"`
+		FileStruct  StructB            `hy:"."`
+		DirMap      map[string]StructB `hy:"/"`
+		Named       StructB            `hy:"Named"`
+	}
+	PathCollisionStruct struct {
+		FooBar  StructB `hy:"."`
+		Foo_Bar StructB `hy:"."`
+	}
+	FieldCollisionStruct struct {
+		FooBar  string
+		Foo_Bar string
+	}
+)
+
+func TestCodec_namingConventions(t *testing.T) {
+	c := newTestCodec(func(c *Codec) {
+		c.PathNames = KebabCase
+		c.FieldNames = SnakeCase
+	})
+	in := NamingStruct{
+		InlineField: "inline",
+		JSONField:   "json",
+		FileStruct:  StructB{Name: "file"},
+		DirMap:      map[string]StructB{"a": {Name: "dir"}},
+		Named:       StructB{Name: "named"},
+	}
+	var out NamingStruct
+	prefix := roundTrip(t, c, "naming-conventions", in, &out)
+
+	expectedFiles := map[string]string{
+		"_":           `{"JSON_field":"json","inline_field":"inline"}`,
+		"file-struct": `{"name":"file"}`,
+		"dir-map/a":   `{"name":"dir"}`,
+		"Named":       `{"name":"named"}`,
+	}
+	for path, expected := range expectedFiles {
+		if actual := readTestFile(t, prefix, path); actual != expected {
+			t.Errorf("got %s at %q; want %s", actual, path, expected)
+		}
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got %+v; want %+v", out, in)
+	}
+}
+
+func TestCodec_namingConventions_collision(t *testing.T) {
+	c := NewCodec(func(c *Codec) {
+		c.PathNames = SnakeCase
+		c.FieldNames = SnakeCase
+	})
+	for expected, input := range map[string]interface{}{
+		`both have path name "foo_bar"`:  PathCollisionStruct{},
+		`both have field name "foo_bar"`: FieldCollisionStruct{},
+	} {
+		_, err := c.Analyse(input)
+		if err == nil {
+			t.Errorf("got nil error analysing %T; want error containing %q", input, expected)
+			continue
+		}
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("got error %q; want it to contain %q", err, expected)
+		}
+	}
+}
@@ -22,3 +22,8 @@ func (ns NodeSet) Register(id NodeID) (*Node, bool) {
 	ns.nodes[id] = n
 	return n, true
 }
+
+// Len returns the number of registered node IDs.
+func (ns NodeSet) Len() int {
+	return len(ns.nodes)
+}
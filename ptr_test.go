@@ -0,0 +1,101 @@
+package hy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type PtrStruct struct {
+	Nil         *StructB           `hy:"nil"`
+	Zero        *StructB           `hy:"zero"`
+	ZeroString  *string            `hy:"zero-string"`
+	PtrPtrNil   **StructB          `hy:"ptr-ptr-nil"`
+	PtrPtrInner **StructB          `hy:"ptr-ptr-inner"`
+	PtrPtr      **StructB          `hy:"ptr-ptr"`
+	Strings     map[string]*string `hy:"strings/"`
+	Structs     []*StructB         `hy:"structs/"`
+	EmptyMap    *map[string]string `hy:"empty-map/"`
+	EmptySlice  *[]string          `hy:"empty-slice/"`
+}
+
+func TestNodeBase_pointers(t *testing.T) {
+	empty, value := "", "value"
+	var nilStructB *StructB
+	structB := &StructB{Name: "ptr-ptr"}
+	in := PtrStruct{
+		Zero:        &StructB{},
+		ZeroString:  &empty,
+		PtrPtrInner: &nilStructB,
+		PtrPtr:      &structB,
+		Strings:     map[string]*string{"nil": nil, "empty": &empty, "value": &value},
+		Structs:     []*StructB{nil, {}},
+		EmptyMap:    &map[string]string{},
+		EmptySlice:  &[]string{},
+	}
+	var out PtrStruct
+	prefix := roundTrip(t, newTestCodec(), "pointers", in, &out)
+
+	expectedFiles := map[string]string{
+		"zero":          `{"Name":""}`,
+		"zero-string":   `""`,
+		"ptr-ptr-inner": `null`,
+		"ptr-ptr":       `{"Name":"ptr-ptr"}`,
+		"strings/nil":   `null`,
+		"strings/empty": `""`,
+		"structs/0":     `null`,
+		"structs/1":     `{"Name":""}`,
+	}
+	for path, expected := range expectedFiles {
+		if actual := readTestFile(t, prefix, path); actual != expected {
+			t.Errorf("got %s at %q; want %s", actual, path, expected)
+		}
+	}
+	// Pointers to empty directories are kept by their own empty files.
+	for _, path := range []string{"empty-map/_", "empty-slice/_"} {
+		b, err := ioutil.ReadFile(filepath.Join(prefix, path+".json"))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if len(b) != 0 {
+			t.Errorf("got %q at %q; want empty file", b, path)
+		}
+	}
+	for _, path := range []string{"nil", "ptr-ptr-nil"} {
+		if _, err := os.Stat(filepath.Join(prefix, path+".json")); !os.IsNotExist(err) {
+			t.Errorf("got %v for %q; want not exist", err, path)
+		}
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got %+v; want %+v", out, in)
+	}
+}
+
+func TestNodeBase_pointers_failure(t *testing.T) {
+	type (
+		ptrPtrElems struct {
+			Map map[string]**StructB `hy:"map/"`
+		}
+		ptrPtrPtr struct {
+			Field ***StructB `hy:"field"`
+		}
+	)
+	c := NewCodec()
+	for expected, input := range map[string]interface{}{
+		"element type **hy.StructB not supported; must not be pointer to pointer": ptrPtrElems{},
+		"cannot analyse pointer to pointer to pointer":                            ptrPtrPtr{},
+	} {
+		_, err := c.Analyse(input)
+		if err == nil {
+			t.Errorf("got nil error for %T; want error containing %q", input, expected)
+			continue
+		}
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("got error %q for %T; want it to contain %q", err, input, expected)
+		}
+	}
+}
@@ -23,6 +23,16 @@ func TestCodec_Read(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	// Key fields are elided from element files, and set from the file name.
+	for key, elem := range v.Map {
+		if elem.Name != key {
+			t.Errorf("got Name %q at key %q; want %q", elem.Name, key, key)
+		}
+	}
+	if elem := v.Nested.MapOfPtr["this-one-has-a-value"]; elem.Name != "this-one-has-a-value" {
+		t.Errorf("got Name %q; want %q", elem.Name, "this-one-has-a-value")
+	}
+
 	if err := os.RemoveAll("testdata/roundtripped"); err != nil {
 		t.Fatal(err)
 	}
@@ -2,7 +2,6 @@ package hy
 
 import (
 	"path"
-	"path/filepath"
 	"sort"
 	"strings"
 
@@ -39,17 +38,26 @@ func (c ReadContext) Push(pathName string) ReadContext {
 	}
 }
 
-// List lists files in the current directory.
+// List lists the names of files and directories in the current directory.
 // TODO: This is horrible, need a tree file structure for targets.
 func (c ReadContext) List() []string {
 	set := map[string]struct{}{}
 	trim := c.Path() + "/"
+	if trim == "/" {
+		trim = ""
+	}
 	for _, path := range c.targets.Paths() {
-		if !strings.HasPrefix(path, trim) {
+		if path == "" || !strings.HasPrefix(path, trim) {
 			continue
 		}
 		p := strings.TrimPrefix(path, trim)
-		p = filepath.Base(p)
+		if i := strings.Index(p, "/"); i != -1 {
+			p = p[:i]
+		}
+		if p == "" {
+			// This directory's own file.
+			continue
+		}
 		set[p] = struct{}{}
 	}
 	l := make([]string, len(set))
@@ -62,20 +70,41 @@ func (c ReadContext) List() []string {
 	return l
 }
 
+// Read reads the file at the current path into v. If there is no file, for
+// example because only a directory exists at the current path, v is left
+// unchanged.
 func (c ReadContext) Read(v interface{}) error {
-	if !c.Exists() {
+	if !c.IsFile() {
 		return nil
 	}
 	return errors.Wrapf(c.Reader.ReadFile(c.Prefix, c.Path(), v), "reading %q", c.Path())
 }
 
-// Exists checks that a file exists at the current path.
+// ReadDir reads the file belonging to the directory at the current path, which
+// is stored inside that directory.
+func (c ReadContext) ReadDir(v interface{}) error {
+	if !c.IsDirFile() {
+		return nil
+	}
+	p := DirFilePath(c.Path())
+	return errors.Wrapf(c.Reader.ReadFile(c.Prefix, p, v), "reading %q", p)
+}
+
+// IsDirFile checks that the directory at the current path has its own file.
+func (c ReadContext) IsDirFile() bool {
+	_, ok := c.targets.Snapshot()[DirFilePath(c.Path())]
+	return ok
+}
+
+// Exists checks that a file or directory exists at the current path.
 func (c ReadContext) Exists() bool {
+	return c.IsFile() || c.IsDirFile() || len(c.List()) != 0
+}
+
+// IsFile checks that a file exists at the current path.
+func (c ReadContext) IsFile() bool {
 	_, ok := c.targets.Snapshot()[c.Path()]
-	if ok {
-		return true
-	}
-	return len(c.List()) != 0
+	return ok
 }
 
 // Path returns the path of this context.
@@ -3,59 +3,446 @@ package hy
 import (
 	"fmt"
 	"reflect"
-	"strconv"
+	"sort"
 
 	"github.com/pkg/errors"
 )
 
+// OrderFileName is the name of the file storing the order of named slice
+// elements, within the slice's directory.
+const OrderFileName = "_order"
+
 // A SliceNode represents a slice to be stored in a directory.
 type SliceNode struct {
 	*DirNodeBase
+	// PairKey and PairValue are the Key and Value fields of elements of a
+	// slice of key/value pairs. They are nil unless the slice is tagged with
+	// the pairs option.
+	PairKey, PairValue *reflect.StructField
 }
 
 // NewSliceNode makes a new slice node.
 func (c *Codec) NewSliceNode(base NodeBase) (Node, error) {
-	n := &SliceNode{&DirNodeBase{NodeBase: base}}
-	return n, errors.Wrap(n.AnalyseElemNode(n, c), "analysing slice element node")
+	n := &SliceNode{DirNodeBase: &DirNodeBase{NodeBase: base}}
+	if n.Field != nil && n.Field.Tag.Pairs {
+		if err := n.analysePairs(); err != nil {
+			return n, errors.Wrapf(err, "analysing pairs %s", n.Type.Elem())
+		}
+	}
+	if n.namedElems() && n.Field.Tag.PadIndices {
+		return n, errors.Errorf("pad cannot be used with elements named by %s", n.keyName())
+	}
+	if n.Field != nil && n.Field.Tag.MaxGap != 0 && n.gaps() != GapsZero {
+		return n, errors.Errorf("maxgap can only be used with gaps=%s", GapsZero)
+	}
+	if n.namedElems() && n.chunkSize() != 0 {
+		return n, errors.Errorf("chunk cannot be used with elements named by %s", n.keyName())
+	}
+	if n.PairValue != nil {
+		return n, errors.Wrap(n.analyseElemNode(n, c, n.PairValue.Type),
+			"analysing pair value node")
+	}
+	if err := n.AnalyseElemNode(n, c); err != nil {
+		return n, errors.Wrap(err, "analysing slice element node")
+	}
+	return n, n.checkChunkElems()
+}
+
+// checkChunkElems returns an error if this slice is stored in chunks but its
+// elements cannot be, since chunk files hold only each element's own file
+// data.
+func (n *SliceNode) checkChunkElems() error {
+	if n.chunkSize() == 0 {
+		return nil
+	}
+	switch elem := (*n.ElemNode).(type) {
+	case *InterfaceNode:
+		return errors.Errorf("chunk cannot be used with interface elements")
+	case *StructNode:
+		if elem.InDir {
+			return errors.Errorf("chunk cannot be used with elemdirs")
+		}
+		if len(elem.Children) != 0 || len(elem.spillPaths) != 0 {
+			return errors.Errorf("chunk cannot be used with elements with fields stored in files of their own; element type is %s",
+				n.Type.Elem())
+		}
+	}
+	return nil
 }
 
-// ChildPathName returns the slice index as a string.
+// analysePairs sets PairKey and PairValue, checking that elements are structs
+// with only the fields Key and Value, and that Key can be a path segment.
+func (n *SliceNode) analysePairs() error {
+	t := n.Type.Elem()
+	if t.Kind() != reflect.Struct {
+		return errors.Errorf("element type must be a struct")
+	}
+	if n.Field.KeyName() != "" {
+		return errors.Errorf("pairs cannot be named by %s", n.Field.KeyName())
+	}
+	key, hasKey := t.FieldByName("Key")
+	value, hasValue := t.FieldByName("Value")
+	if !hasKey || !hasValue || len(key.Index) != 1 || len(value.Index) != 1 ||
+		t.NumField() != 2 {
+		return errors.Errorf("element type must have only fields Key and Value")
+	}
+	if err := checkKeyKind(key.Type); err != nil {
+		return errors.Wrapf(err, "field Key")
+	}
+	n.PairKey, n.PairValue = &key, &value
+	return nil
+}
+
+// ChildPathName returns the slice index as a string, or the element's name if
+// elements are named.
 func (n *SliceNode) ChildPathName(child Node, key, val reflect.Value) string {
+	if n.namedElems() {
+		name, _ := n.elemName(val)
+		return name
+	}
 	return fmt.Sprint(key)
 }
 
-// ReadTargets reads targets into slice indicies.
+// namedElems returns true if elements are stored in files named by their key
+// field or get key method, or by the key of each pair.
+func (n *SliceNode) namedElems() bool {
+	return n.Field != nil && n.Field.NamedElems || n.PairKey != nil
+}
+
+// keyName returns the name of the key elements are named by, for use in
+// messages.
+func (n *SliceNode) keyName() string {
+	if n.PairKey != nil {
+		return n.PairKey.Name
+	}
+	return n.Field.KeyName()
+}
+
+// elemName returns the name of a named element.
+func (n *SliceNode) elemName(val reflect.Value) (string, error) {
+	if val.Kind() == reflect.Ptr {
+		if val.IsNil() {
+			return "", errors.Errorf("nil element has no %s", n.keyName())
+		}
+		val = val.Elem()
+	}
+	var name string
+	if n.PairKey != nil {
+		name = fmt.Sprint(val.FieldByIndex(n.PairKey.Index))
+	} else {
+		name = n.Field.GetKeyFunc.Call([]reflect.Value{val})[0].String()
+	}
+	if name == "" {
+		return "", errors.Errorf("element has empty %s", n.keyName())
+	}
+	if name == OrderFileName {
+		return "", errors.Errorf("element %s %q is reserved", n.keyName(), name)
+	}
+	if !isPathSegment(name) {
+		return "", errors.Errorf("element %s %q is not a valid path segment", n.keyName(), name)
+	}
+	return name, nil
+}
+
+// chunkSize returns the number of elements stored in each chunk file, or zero
+// if elements are stored in their own files. Elements which are maps or
+// slices stored in directories leave chunks to the innermost slices.
+func (n *SliceNode) chunkSize() int {
+	if n.Field == nil || n.ElemNode != nil && isDirCollection(*n.ElemNode) {
+		return 0
+	}
+	return n.Field.Tag.Chunk
+}
+
+// chunkName returns the path name of chunk i.
+func chunkName(i int) string {
+	return fmt.Sprintf("%04d", i)
+}
+
+// gaps returns the policy for missing indices.
+func (n *SliceNode) gaps() string {
+	if n.Field == nil || n.Field.Tag.Gaps == "" {
+		return GapsCompact
+	}
+	return n.Field.Tag.Gaps
+}
+
+// maxGap returns the largest number of missing elements read as zero values.
+func (n *SliceNode) maxGap() int {
+	if n.Field == nil || n.Field.Tag.MaxGap == 0 {
+		return DefaultMaxGap
+	}
+	return n.Field.Tag.MaxGap
+}
+
+// ReadTargets reads targets into slice indicies. Missing indices are handled
+// according to the gaps policy.
 func (n *SliceNode) ReadTargets(c ReadContext, key reflect.Value) (reflect.Value, error) {
-	list := c.List()
-	val := reflect.MakeSlice(n.Type, len(list), len(list))
-	for _, indexStr := range list {
-		index, err := strconv.Atoi(indexStr)
-		if err != nil {
-			return val, errors.Wrapf(err, "converting %q to int", indexStr)
+	if n.namedElems() {
+		return n.readNamed(c)
+	}
+	if n.chunkSize() != 0 {
+		return n.readChunks(c)
+	}
+	indices, names, err := n.indices(c)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	length := len(indices)
+	if n.gaps() == GapsZero && length != 0 {
+		last := indices[length-1]
+		if missing := last + 1 - length; missing > n.maxGap() {
+			return reflect.Value{}, errors.Errorf("index %d leaves more than %d elements missing",
+				last, n.maxGap())
+		}
+		length = last + 1
+	}
+	val := reflect.MakeSlice(n.Type, length, length)
+	for i, index := range indices {
+		if index != i {
+			switch n.gaps() {
+			case GapsCompact:
+				// Elements move down to fill the gap.
+				index = i
+			case GapsError:
+				return val, errors.Errorf("index %d missing", i)
+			}
 		}
 		elemKey := reflect.ValueOf(index)
-		elem := *n.ElemNode
-		elemContext := c.Push(indexStr)
-		elemVal, err := elem.Read(elemContext, elemKey)
+		elemVal, err := (*n.ElemNode).Read(c.Push(names[i]), elemKey)
 		if err != nil {
 			return val, errors.Wrapf(err, "reading index %d", index)
 		}
-		reflect.Append(val, elemVal)
-		val.Index(index).Set(elemVal)
+		val.Index(index).Set(n.SetElemKey(elemVal, elemKey))
+	}
+	return val, nil
+}
+
+// readChunks reads each chunk file in turn, appending its elements. Missing
+// chunks are handled according to the gaps policy.
+func (n *SliceNode) readChunks(c ReadContext) (reflect.Value, error) {
+	size := n.chunkSize()
+	indices, names, err := n.indices(c)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	val := reflect.MakeSlice(n.Type, 0, len(indices)*size)
+	missing := 0
+	for i, index := range indices {
+		if index != i {
+			switch n.gaps() {
+			case GapsZero:
+				// Missing chunks are full of zero values.
+				// Compare indices rather than counts of elements, which
+				// may overflow.
+				if index > (n.maxGap()-missing+val.Len())/size {
+					return val, errors.Errorf("chunk %d leaves more than %d elements missing",
+						index, n.maxGap())
+				}
+				missing += index*size - val.Len()
+				zero := reflect.Zero(n.Type.Elem())
+				for val.Len() < index*size {
+					val = reflect.Append(val, zero)
+				}
+			case GapsError:
+				return val, errors.Errorf("chunk %d missing", i)
+			}
+		}
+		chunk, err := n.readChunk(c.Push(names[i]))
+		if err != nil {
+			return val, errors.Wrapf(err, "reading chunk %d", index)
+		}
+		if l := chunk.Len(); l > size {
+			return val, errors.Errorf("chunk %d has %d elements; want at most %d", index, l, size)
+		}
+		for j := 0; j < chunk.Len(); j++ {
+			elemKey := reflect.ValueOf(val.Len())
+			val = reflect.Append(val, n.SetElemKey(chunk.Index(j), elemKey))
+		}
+	}
+	return val, nil
+}
+
+// readChunk reads the elements in the chunk file at c. Struct elements are
+// read from their file data, like their own files.
+func (n *SliceNode) readChunk(c ReadContext) (reflect.Value, error) {
+	elemNode, ok := (*n.ElemNode).(*StructNode)
+	if !ok || elemNode.fileType == nil {
+		chunk := reflect.New(n.Type)
+		err := c.Read(chunk.Interface())
+		return chunk.Elem(), err
+	}
+	fileVals := reflect.New(reflect.SliceOf(reflect.PtrTo(elemNode.fileType)))
+	if err := c.Read(fileVals.Interface()); err != nil {
+		return reflect.Value{}, err
+	}
+	chunk := reflect.MakeSlice(n.Type, fileVals.Elem().Len(), fileVals.Elem().Len())
+	for i := 0; i < chunk.Len(); i++ {
+		fileVal := fileVals.Elem().Index(i)
+		if fileVal.IsNil() {
+			// A null element is left zero, or nil if it is a pointer.
+			continue
+		}
+		v := reflect.New(elemNode.Type)
+		elemNode.setFields(v.Elem(), fileVal.Elem())
+		if !elemNode.IsPtr {
+			v = v.Elem()
+		}
+		chunk.Index(i).Set(v)
+	}
+	return chunk, nil
+}
+
+// readNamed reads named elements in the order listed in the order file.
+// Elements not listed in the order file are appended in name order, and names
+// listed in the order file with no corresponding element are ignored.
+func (n *SliceNode) readNamed(c ReadContext) (reflect.Value, error) {
+	var order []string
+	if err := c.Push(OrderFileName).Read(&order); err != nil {
+		return reflect.Value{}, errors.Wrapf(err, "reading order file")
+	}
+	unordered := map[string]struct{}{}
+	for _, name := range n.List(c) {
+		if name != OrderFileName {
+			unordered[name] = struct{}{}
+		}
+	}
+	var names []string
+	for _, name := range order {
+		if _, ok := unordered[name]; ok {
+			names = append(names, name)
+			delete(unordered, name)
+		}
+	}
+	rest := make([]string, 0, len(unordered))
+	for name := range unordered {
+		rest = append(rest, name)
+	}
+	sort.Strings(rest)
+	names = append(names, rest...)
+
+	val := reflect.MakeSlice(n.Type, 0, len(names))
+	for _, name := range names {
+		elemKey, err := n.parseElemName(name)
+		if err != nil {
+			return val, errors.Wrapf(err, "reading element %q", name)
+		}
+		elemVal, err := (*n.ElemNode).Read(c.Push(name), elemKey)
+		if err != nil {
+			return val, errors.Wrapf(err, "reading element %q", name)
+		}
+		if n.PairKey == nil {
+			val = reflect.Append(val, n.SetElemKey(elemVal, elemKey))
+			continue
+		}
+		pair := reflect.New(n.Type.Elem()).Elem()
+		pair.FieldByIndex(n.PairKey.Index).Set(elemKey)
+		pair.FieldByIndex(n.PairValue.Index).Set(elemVal)
+		val = reflect.Append(val, pair)
 	}
 	return val, nil
 }
 
+// parseElemName returns the key of the named element called name.
+func (n *SliceNode) parseElemName(name string) (reflect.Value, error) {
+	if n.PairKey != nil {
+		return parseKey(name, n.PairKey.Type)
+	}
+	return reflect.ValueOf(name).Convert(n.Field.KeyType), nil
+}
+
 // WriteTargets writes all the elements of the slice.
 func (n *SliceNode) WriteTargets(c WriteContext, key, val reflect.Value) error {
+	if !val.IsValid() {
+		// A nil pointer to a map or slice has no elements.
+		return nil
+	}
+	if n.namedElems() {
+		return n.writeNamed(c, val)
+	}
+	if n.chunkSize() != 0 {
+		return n.writeChunks(c, val)
+	}
 	elemNode := *n.ElemNode
 	for i := 0; i < val.Len(); i++ {
-		v := val.Index(i)
 		k := reflect.ValueOf(i)
-		childContext := c.Push(elemNode.PathName(k, v))
+		v := n.SetElemKey(val.Index(i), k)
+		p := n.indexName(i, val.Len())
+		if err := n.checkElemPath(p); err != nil {
+			return errors.Wrapf(err, "writing slice index %d failed", i)
+		}
+		childContext := c.Push(p)
 		if err := elemNode.Write(childContext, k, v); err != nil {
 			return errors.Wrapf(err, "writing slice index %d failed", i)
 		}
 	}
 	return nil
 }
+
+// writeChunks writes the elements of the slice to chunk files, each holding
+// up to the chunk size of elements, in order.
+func (n *SliceNode) writeChunks(c WriteContext, val reflect.Value) error {
+	size := n.chunkSize()
+	for i := 0; i*size < val.Len(); i++ {
+		end := (i + 1) * size
+		if end > val.Len() {
+			end = val.Len()
+		}
+		chunk := make([]interface{}, 0, end-i*size)
+		for j := i * size; j < end; j++ {
+			chunk = append(chunk, n.chunkElem(n.SetElemKey(val.Index(j), reflect.ValueOf(j))))
+		}
+		p := chunkName(i)
+		if err := n.checkElemPath(p); err != nil {
+			return errors.Wrapf(err, "writing chunk %d failed", i)
+		}
+		if err := c.Push(p).SetValue(chunk); err != nil {
+			return errors.Wrapf(err, "writing chunk %d failed", i)
+		}
+	}
+	return nil
+}
+
+// chunkElem returns the data of elem in its chunk file. Struct elements are
+// written as their file data, like their own files, so their keys are elided.
+func (n *SliceNode) chunkElem(elem reflect.Value) interface{} {
+	elemNode, ok := (*n.ElemNode).(*StructNode)
+	if !ok {
+		return elem.Interface()
+	}
+	if elem.Kind() == reflect.Ptr {
+		if elem.IsNil() {
+			return nil
+		}
+		elem = elem.Elem()
+	}
+	return elemNode.prepareFileData(elem, nil)
+}
+
+// writeNamed writes each element to a file named by its key, and their order
+// to the order file. Only the value of each key/value pair is written.
+func (n *SliceNode) writeNamed(c WriteContext, val reflect.Value) error {
+	elemNode := *n.ElemNode
+	order := make([]string, val.Len())
+	for i := range order {
+		v := val.Index(i)
+		name, err := n.elemName(v)
+		if err == nil {
+			err = n.checkElemPath(name)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "naming slice index %d", i)
+		}
+		var k reflect.Value
+		if n.PairKey != nil {
+			k, v = v.FieldByIndex(n.PairKey.Index), v.FieldByIndex(n.PairValue.Index)
+		} else {
+			k = reflect.ValueOf(name).Convert(n.Field.KeyType)
+		}
+		if err := elemNode.Write(c.Push(name), k, v); err != nil {
+			return errors.Wrapf(err, "writing slice element %q failed", name)
+		}
+		order[i] = name
+	}
+	return errors.Wrap(c.Push(OrderFileName).SetValue(order), "writing order file")
+}
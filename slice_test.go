@@ -0,0 +1,477 @@
+package hy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type (
+	IndexedElem struct {
+		Index int
+		Name  string
+	}
+	SetIndexElem struct {
+		Name  string
+		index int
+	}
+	NamedElem struct {
+		Name  string
+		Value int
+	}
+	SliceKeyStruct struct {
+		Indexed    []IndexedElem   `hy:"indexed/,Index"`
+		SetIndex   []*SetIndexElem `hy:"set-index/,,SetIndex()"`
+		Named      []NamedElem     `hy:"named/,Name"`
+		NamedEmpty []NamedElem     `hy:"named-empty/,Name"`
+	}
+)
+
+func (e *SetIndexElem) SetIndex(i int) { e.index = i }
+
+func TestSliceNode_keyFields(t *testing.T) {
+	in := SliceKeyStruct{
+		Indexed: []IndexedElem{{Name: "zero"}, {Name: "one"}},
+		SetIndex: []*SetIndexElem{
+			{Name: "zero"}, {Name: "one"},
+		},
+		Named: []NamedElem{
+			{Name: "b", Value: 1}, {Name: "a", Value: 2}, {Name: "c", Value: 3},
+		},
+		NamedEmpty: []NamedElem{},
+	}
+	var out SliceKeyStruct
+	prefix := roundTrip(t, newTestCodec(), "slice-key-fields", in, &out)
+
+	expectedFiles := map[string]string{
+		"indexed/1":                    `{"Name":"one"}`,
+		"set-index/1":                  `{"Name":"one"}`,
+		"named/a":                      `{"Value":2}`,
+		"named/" + OrderFileName:       `["b","a","c"]`,
+		"named-empty/" + OrderFileName: `[]`,
+	}
+	for path, expected := range expectedFiles {
+		if actual := readTestFile(t, prefix, path); actual != expected {
+			t.Errorf("got %s at %q; want %s", actual, path, expected)
+		}
+	}
+
+	expected := SliceKeyStruct{
+		Indexed: []IndexedElem{{Index: 0, Name: "zero"}, {Index: 1, Name: "one"}},
+		SetIndex: []*SetIndexElem{
+			{Name: "zero", index: 0}, {Name: "one", index: 1},
+		},
+		Named:      in.Named,
+		NamedEmpty: in.NamedEmpty,
+	}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("got %+v; want %+v", out, expected)
+	}
+}
+
+type (
+	MethodElem struct {
+		Kind, Name string
+	}
+	SliceMethodStruct struct {
+		Methods []MethodElem `hy:"methods/,Key()"`
+	}
+)
+
+func (e *MethodElem) Key() string { return e.Kind + "-" + e.Name }
+
+func TestSliceNode_namedElems_keyMethod(t *testing.T) {
+	in := SliceMethodStruct{Methods: []MethodElem{
+		{Kind: "b", Name: "one"}, {Kind: "a", Name: "two"}, {Kind: "c", Name: "three"},
+	}}
+	var out SliceMethodStruct
+	prefix := roundTrip(t, newTestCodec(), "slice-key-method", in, &out)
+
+	expectedFiles := map[string]string{
+		"methods/a-two":            `{"Kind":"a","Name":"two"}`,
+		"methods/" + OrderFileName: `["b-one","a-two","c-three"]`,
+	}
+	for path, expected := range expectedFiles {
+		if actual := readTestFile(t, prefix, path); actual != expected {
+			t.Errorf("got %s at %q; want %s", actual, path, expected)
+		}
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got %+v; want %+v", out, in)
+	}
+
+	// Reordering elements only changes the order file.
+	orderFile := filepath.Join(prefix, "methods", OrderFileName+".json")
+	if err := ioutil.WriteFile(orderFile, []byte(`["c-three","b-one"]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out = SliceMethodStruct{}
+	if err := newTestCodec().Read(prefix, &out); err != nil {
+		t.Fatal(err)
+	}
+	expected := []MethodElem{in.Methods[2], in.Methods[0], in.Methods[1]}
+	if !reflect.DeepEqual(out.Methods, expected) {
+		t.Errorf("got %+v; want %+v", out.Methods, expected)
+	}
+}
+
+func TestSliceNode_namedElems_failure(t *testing.T) {
+	c := newTestCodec()
+	for _, in := range []SliceKeyStruct{
+		{Named: []NamedElem{{Name: ""}}},
+		{Named: []NamedElem{{Name: OrderFileName}}},
+		{Named: []NamedElem{{Name: "../x"}}},
+		{Named: []NamedElem{{Name: "a/b"}}},
+		{Named: []NamedElem{{Name: "_"}}},
+		{Named: []NamedElem{{Name: "a"}, {Name: "a"}}},
+	} {
+		if err := c.Write(filepath.Join(t.TempDir(), "slice-named-failure"), in); err == nil {
+			t.Errorf("got nil error writing %+v", in.Named)
+		}
+	}
+}
+
+type SliceGapsStruct struct {
+	Compact []IndexedElem `hy:"compact/,Index"`
+	Zero    []IndexedElem `hy:"zero/,Index,gaps=zero"`
+	Error   []IndexedElem `hy:"error/,Index,gaps=error"`
+	Limited []IndexedElem `hy:"limited/,Index,gaps=zero,maxgap=2"`
+}
+
+func TestSliceNode_gaps(t *testing.T) {
+	elems := make([]IndexedElem, 12)
+	for i := range elems {
+		elems[i] = IndexedElem{Index: i, Name: fmt.Sprint("elem ", i)}
+	}
+	in := SliceGapsStruct{Compact: elems, Zero: elems}
+	prefix := roundTrip(t, newTestCodec(), "slice-gaps", in, &SliceGapsStruct{})
+
+	// Leave indices 0, 5 and 10, which are not in order by name.
+	for _, dir := range []string{"compact", "zero"} {
+		for _, i := range []int{1, 2, 3, 4, 6, 7, 8, 9, 11} {
+			if err := os.Remove(filepath.Join(prefix, dir, fmt.Sprint(i, ".json"))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	var out SliceGapsStruct
+	if err := newTestCodec().Read(prefix, &out); err != nil {
+		t.Fatal(err)
+	}
+	expectedCompact := []IndexedElem{
+		{Index: 0, Name: "elem 0"}, {Index: 1, Name: "elem 5"}, {Index: 2, Name: "elem 10"},
+	}
+	if !reflect.DeepEqual(out.Compact, expectedCompact) {
+		t.Errorf("got %+v; want %+v", out.Compact, expectedCompact)
+	}
+	expectedZero := make([]IndexedElem, 11)
+	expectedZero[0], expectedZero[5], expectedZero[10] = elems[0], elems[5], elems[10]
+	if !reflect.DeepEqual(out.Zero, expectedZero) {
+		t.Errorf("got %+v; want %+v", out.Zero, expectedZero)
+	}
+}
+
+func TestSliceNode_gaps_failure(t *testing.T) {
+	for expected, names := range map[string][]string{
+		"index 1 missing":                             {"error/0", "error/2"},
+		`element name "x" is not an index`:            {"compact/0", "compact/x"},
+		`element name "-1" is a negative index`:       {"zero/-1"},
+		`element names "01" and "1" are both index 1`: {"compact/01", "compact/1"},
+		"index 4 leaves more than 2 elements missing": {"limited/0", "limited/4"},
+		"index 9223372036854775806 leaves more than 10000 elements missing": {
+			"zero/9223372036854775806",
+		},
+	} {
+		prefix := filepath.Join(t.TempDir(), "slice-gaps-failure")
+		for _, name := range append(names, "_") {
+			p := filepath.Join(prefix, name+".json")
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(p, []byte(`{}`), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := newTestCodec().Read(prefix, &SliceGapsStruct{})
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("got error %v reading %q; want it to contain %q", err, names, expected)
+		}
+	}
+}
+
+type (
+	SlicePadStruct struct {
+		Slice  []IndexedElem `hy:"slice/,Index,pad"`
+		Nested [][]StructB   `hy:"nested/,pad"`
+		Array  [100]StructB  `hy:"array/,pad"`
+		Short  []IndexedElem `hy:"short/,Index,pad"`
+	}
+	SliceNoPadStruct struct {
+		Slice []IndexedElem `hy:"slice/,Index"`
+	}
+)
+
+func TestSliceNode_pad(t *testing.T) {
+	elems := make([]IndexedElem, 12)
+	for i := range elems {
+		elems[i] = IndexedElem{Index: i, Name: fmt.Sprint("elem ", i)}
+	}
+	nested := make([][]StructB, 11)
+	nested[10] = []StructB{{Name: "10-0"}}
+	in := SlicePadStruct{Slice: elems, Nested: nested, Short: elems[:3]}
+	in.Array[7] = StructB{Name: "7"}
+	var out SlicePadStruct
+	prefix := roundTrip(t, newTestCodec(), "slice-pad", in, &out)
+
+	expectedFiles := map[string]string{
+		"slice/00":    `{"Name":"elem 0"}`,
+		"slice/11":    `{"Name":"elem 11"}`,
+		"nested/10/0": `{"Name":"10-0"}`,
+		"array/07":    `{"Name":"7"}`,
+		"array/99":    `{"Name":""}`,
+		"short/2":     `{"Name":"elem 2"}`,
+	}
+	for path, expected := range expectedFiles {
+		if actual := readTestFile(t, prefix, path); actual != expected {
+			t.Errorf("got %s at %q; want %s", actual, path, expected)
+		}
+	}
+	expected := in
+	expected.Nested = [][]StructB{{{Name: "10-0"}}}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("got %+v; want %+v", out, expected)
+	}
+
+	// Unpadded indices are read in numeric order, with or without pad.
+	prefix = roundTrip(t, newTestCodec(), "slice-nopad", SliceNoPadStruct{elems}, &SliceNoPadStruct{})
+	var padded SlicePadStruct
+	if err := newTestCodec().Read(prefix, &padded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(padded.Slice, elems) {
+		t.Errorf("got %+v; want %+v", padded.Slice, elems)
+	}
+}
+
+func TestSliceNode_pad_failure(t *testing.T) {
+	type namedPad struct {
+		Slice []NamedElem `hy:"slice/,Name,pad"`
+	}
+	_, err := NewCodec().Analyse(namedPad{})
+	if expected := "pad cannot be used with elements named by Name"; err == nil ||
+		!strings.Contains(err.Error(), expected) {
+		t.Errorf("got error %v; want it to contain %q", err, expected)
+	}
+}
+
+type (
+	PipelineStep struct {
+		Image  string
+		Config StructB `hy:"config"`
+	}
+	StepPair struct {
+		Key   string
+		Value PipelineStep
+	}
+	IntPair struct {
+		Key   int
+		Value string
+	}
+	SlicePairsStruct struct {
+		Steps []StepPair `hy:"steps/,pairs"`
+		Ints  []IntPair  `hy:"ints/,pairs"`
+	}
+)
+
+func TestSliceNode_pairs(t *testing.T) {
+	in := SlicePairsStruct{
+		Steps: []StepPair{
+			{Key: "test", Value: PipelineStep{Image: "golang"}},
+			{Key: "build", Value: PipelineStep{Image: "docker", Config: StructB{Name: "config"}}},
+			{Key: "deploy"},
+		},
+		Ints: []IntPair{{Key: 10, Value: "ten"}, {Key: 2, Value: "two"}},
+	}
+	var out SlicePairsStruct
+	prefix := roundTrip(t, newTestCodec(), "slice-pairs", in, &out)
+
+	expectedFiles := map[string]string{
+		"steps/test":             `{"Image":"golang"}`,
+		"steps/build":            `{"Image":"docker"}`,
+		"steps/build/config":     `{"Name":"config"}`,
+		"steps/deploy":           `{"Image":""}`,
+		"steps/" + OrderFileName: `["test","build","deploy"]`,
+		"ints/10":                `"ten"`,
+		"ints/" + OrderFileName:  `["10","2"]`,
+	}
+	for path, expected := range expectedFiles {
+		if actual := readTestFile(t, prefix, path); actual != expected {
+			t.Errorf("got %s at %q; want %s", actual, path, expected)
+		}
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got %+v; want %+v", out, in)
+	}
+}
+
+func TestSliceNode_pairs_failure(t *testing.T) {
+	type (
+		notStruct struct {
+			Pairs []string `hy:"pairs/,pairs"`
+		}
+		extraField struct {
+			Pairs []struct{ Key, Value, Other string } `hy:"pairs/,pairs"`
+		}
+		keyField struct {
+			Pairs []StepPair `hy:"pairs/,Key,pairs"`
+		}
+		structKey struct {
+			Pairs []struct {
+				Key   StructB
+				Value string
+			} `hy:"pairs/,pairs"`
+		}
+	)
+	c := NewCodec()
+	for expected, input := range map[string]interface{}{
+		"element type must be a struct":                    notStruct{},
+		"element type must have only fields Key and Value": extraField{},
+		"pairs cannot be named by Key":                     keyField{},
+		"field Key: kind struct not supported":             structKey{},
+	} {
+		_, err := c.Analyse(input)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("got error %v for %T; want it to contain %q", err, input, expected)
+		}
+	}
+	in := SlicePairsStruct{Steps: []StepPair{{Key: "a/b"}}}
+	err := c.Write(filepath.Join(t.TempDir(), "slice-pairs-failure"), in)
+	if expected := `element Key "a/b" is not a valid path segment`; err == nil ||
+		!strings.Contains(err.Error(), expected) {
+		t.Errorf("got error %v; want it to contain %q", err, expected)
+	}
+}
+
+type SliceChunkStruct struct {
+	Events []IndexedElem `hy:"events/,Index,chunk=2"`
+	Ints   []int         `hy:"ints/,chunk=3,gaps=zero"`
+	Empty  []int         `hy:"empty/,chunk=3"`
+	Ptrs   []*NamedElem  `hy:"ptrs/,chunk=2"`
+	// Chunks apply to the innermost slices.
+	Nested [][]int `hy:"nested/,chunk=2"`
+}
+
+func TestSliceNode_chunks(t *testing.T) {
+	in := SliceChunkStruct{
+		Events: []IndexedElem{
+			{Index: 0, Name: "a"}, {Index: 1, Name: "b"}, {Index: 2, Name: "c"},
+			{Index: 3, Name: "d"}, {Index: 4, Name: "e"},
+		},
+		Ints:   []int{1, 2, 3, 4, 5, 6, 7},
+		Ptrs:   []*NamedElem{{Name: "a", Value: 1}, nil},
+		Nested: [][]int{{1, 2, 3}},
+	}
+	var out SliceChunkStruct
+	c := newTestCodec(func(c *Codec) { c.FieldNames = SnakeCase })
+	prefix := roundTrip(t, c, "slice-chunks", in, &out)
+
+	expectedFiles := map[string]string{
+		// Elements are written like their own files, with keys elided.
+		"events/0000":   `[{"name":"a"},{"name":"b"}]`,
+		"events/0002":   `[{"name":"e"}]`,
+		"ints/0001":     `[4,5,6]`,
+		"ints/0002":     `[7]`,
+		"ptrs/0000":     `[{"name":"a","value":1},null]`,
+		"nested/0/0001": `[3]`,
+	}
+	for path, expected := range expectedFiles {
+		if actual := readTestFile(t, prefix, path); actual != expected {
+			t.Errorf("got %s at %q; want %s", actual, path, expected)
+		}
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got %+v; want %+v", out, in)
+	}
+
+	// Missing chunks follow the gaps policy.
+	for _, path := range []string{"events/0001.json", "ints/0001.json"} {
+		if err := os.Remove(filepath.Join(prefix, path)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out = SliceChunkStruct{}
+	if err := c.Read(prefix, &out); err != nil {
+		t.Fatal(err)
+	}
+	expected := in
+	expected.Events = []IndexedElem{
+		{Index: 0, Name: "a"}, {Index: 1, Name: "b"}, {Index: 2, Name: "e"},
+	}
+	expected.Ints = []int{1, 2, 3, 0, 0, 0, 7}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("got %+v; want %+v", out, expected)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(prefix, "ints/0001.json"),
+		[]byte(`[1,2,3,4]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := c.Read(prefix, &SliceChunkStruct{})
+	if expected := "chunk 1 has 4 elements; want at most 3"; err == nil ||
+		!strings.Contains(err.Error(), expected) {
+		t.Errorf("got error %v; want it to contain %q", err, expected)
+	}
+
+	if err := os.Rename(filepath.Join(prefix, "ints/0001.json"),
+		filepath.Join(prefix, "ints/9223372036854775806.json")); err != nil {
+		t.Fatal(err)
+	}
+	err = c.Read(prefix, &SliceChunkStruct{})
+	if expected := "chunk 9223372036854775806 leaves more than 10000 elements missing"; err == nil ||
+		!strings.Contains(err.Error(), expected) {
+		t.Errorf("got error %v; want it to contain %q", err, expected)
+	}
+}
+
+func TestSliceNode_chunks_failure(t *testing.T) {
+	type (
+		namedChunks struct {
+			Slice []NamedElem `hy:"slice/,Name,chunk=10"`
+		}
+		interfaceChunks struct {
+			Slice []Plugin `hy:"slice/,chunk=2"`
+		}
+		childChunks struct {
+			Slice []RedisPlugin `hy:"slice/,chunk=2"`
+		}
+		elemDirChunks struct {
+			Slice []NamedElem `hy:"slice/,chunk=2,elemdirs"`
+		}
+	)
+	for expected, input := range map[string]interface{}{
+		"chunk cannot be used with elements named by Name":                                                            namedChunks{},
+		"chunk cannot be used with interface elements":                                                                interfaceChunks{},
+		"chunk cannot be used with elements with fields stored in files of their own; element type is hy.RedisPlugin": childChunks{},
+		"chunk cannot be used with elemdirs":                                                                          elemDirChunks{},
+	} {
+		_, err := NewCodec().Analyse(input)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("got error %v for %T; want it to contain %q", err, input, expected)
+		}
+	}
+}
+
+func TestSliceNode_maxGap_failure(t *testing.T) {
+	type maxGapCompact struct {
+		Slice []StructB `hy:"slice/,maxgap=10"`
+	}
+	_, err := NewCodec().Analyse(maxGapCompact{})
+	if expected := "maxgap can only be used with gaps=zero"; err == nil ||
+		!strings.Contains(err.Error(), expected) {
+		t.Errorf("got error %v; want it to contain %q", err, expected)
+	}
+}
@@ -1,7 +1,12 @@
 package hy
 
 import (
+	"encoding/json"
+	"fmt"
+	"path"
 	"reflect"
+	"sort"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -9,10 +14,42 @@ import (
 // StructNode represents a struct to be stored in a file.
 type StructNode struct {
 	FileNode
-	// Fields is a map of simple struct field names to their types.
+	// Fields is a map of simple struct field names to their types in this
+	// struct's file. Fields of embedded structs are included by their own
+	// names.
 	Fields map[string]reflect.Type
-	// Children is a map of field named to node pointers.
+	// FieldNames is a map of simple struct field names to their names in this
+	// struct's file.
+	FieldNames map[string]string
+	// Children is a map of field named to node pointers. Tagged fields within
+	// inline struct fields are named like "Inline.Child".
 	Children map[string]*Node
+	// ElidedField is the name of the key field left out of this struct's file
+	// when it is a map or slice element. It is empty if no field is elided.
+	ElidedField string
+	// InDir indicates this struct is a map or slice element stored in its own
+	// directory, with its file inside that directory.
+	InDir bool
+	// fileType is a struct type with a field for each of Fields, tagged with
+	// its name in this struct's file. It is nil if all fields are named the
+	// same in the file as in the struct.
+	fileType reflect.Type
+	// index maps the names of Fields and Children to their index sequences,
+	// which have more than one element for fields of embedded structs.
+	index map[string][]int
+	// inline maps the names of Fields whose inline struct types contain
+	// tagged fields to their conversions to and from their types in Fields.
+	inline map[string]*inlineType
+	// spillSize is the size above which values of Fields are spilled to
+	// their own files, named by spillPaths. It is zero if values are never
+	// spilled.
+	spillSize int
+	// spillField is the name of the field in this struct's file listing the
+	// file names of spilled fields, and spillFieldName is its name in
+	// fileType.
+	spillField, spillFieldName string
+	// spillPaths maps the names of Fields to their paths when spilled.
+	spillPaths map[string]string
 }
 
 // NewStructNode makes a new struct node.
@@ -22,21 +59,107 @@ func (c *Codec) NewStructNode(base NodeBase) (Node, error) {
 		FileNode: FileNode{
 			NodeBase: base,
 		},
-		Fields:   map[string]reflect.Type{},
-		Children: map[string]*Node{},
+		Fields:     map[string]reflect.Type{},
+		FieldNames: map[string]string{},
+		Children:   map[string]*Node{},
+		index:      map[string][]int{},
+		inline:     map[string]*inlineType{},
+		spillSize:  c.SpillSize,
+		spillField: c.SpillField,
+		spillPaths: map[string]string{},
 	}
-	for i := 0; i < n.Type.NumField(); i++ {
-		field, err := NewFieldInfo(n.Type.Field(i)) //tag, Name: field.Name)
+	if n.HasKey && n.Field != nil && n.Field.ElidesKeyField() {
+		n.ElidedField = n.Field.KeyField
+	}
+	// Elements are stored in directories if their map or slice field has the
+	// elemdirs option.
+	n.InDir = n.HasKey && n.Field != nil && n.Field.Tag.ElemDirs
+	// entries is the name of the field whose elements are stored directly in
+	// this struct's directory, if any.
+	var entries string
+	// fileNames and pathNames map names in the file and child path names to
+	// the fields using them, to detect collisions.
+	fileNames, pathNames := map[string]string{}, map[string]string{}
+	fields, err := structFields(n.Type)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading fields of %s", n.Type)
+	}
+	// Tagged fields within inline struct fields are appended to fields as
+	// they are found.
+	for i := 0; i < len(fields); i++ {
+		sf := fields[i]
+		field, err := NewFieldInfo(sf)
 		if err != nil {
-			return nil, errors.Wrapf(err, "reading field %s.%s", n.Type, n.Type.Field(i).Name)
+			return nil, errors.Wrapf(err, "reading field %s.%s", n.Type, sf.Name)
 		}
+		if field.Ignore {
+			continue
+		}
+		n.index[field.Name] = sf.Index
 		if field.Tag.None {
+			if field.AutoFieldName {
+				field.FieldName = c.FieldNames.name(field.Name)
+			}
+			if other, ok := fileNames[field.FieldName]; ok {
+				return nil, errors.Errorf("fields %s.%s and %s.%s both have field name %q",
+					n.Type, other, n.Type, field.Name, field.FieldName)
+			}
+			fileNames[field.FieldName] = field.Name
+			if n.spillSize != 0 {
+				if field.FieldName == n.spillField {
+					return nil, errors.Errorf("field %s.%s has the same name as spill field %q",
+						n.Type, field.Name, n.spillField)
+				}
+				// Spilled values are stored like children, so their paths
+				// must not collide with those of children.
+				spillPath := c.PathNames.name(field.Name)
+				if other, ok := pathNames[spillPath]; ok {
+					return nil, errors.Errorf("fields %s.%s and %s.%s both have path name %q",
+						n.Type, other, n.Type, field.Name, spillPath)
+				}
+				pathNames[spillPath] = field.Name
+				n.spillPaths[field.Name] = spillPath
+			}
 			n.Fields[field.Name] = field.Type
+			if it, tagged := newInlineType(field.Type, map[reflect.Type]bool{}); it != nil {
+				n.inline[field.Name] = it
+				n.Fields[field.Name] = it.FileTypeOf(field.Type)
+				for _, child := range tagged {
+					child.Name = field.Name + "." + child.Name
+					child.Index = append(append([]int(nil), sf.Index...), child.Index...)
+					fields = append(fields, child)
+				}
+			}
+			n.FieldNames[field.Name] = field.FieldName
 			continue
 		}
-		if field.Tag.Ignore {
-			continue
+		if field.Tag.Entries {
+			if entries != "" {
+				return nil, errors.Errorf("fields %s.%s and %s.%s both have entries option",
+					n.Type, entries, n.Type, field.Name)
+			}
+			entries = field.Name
+		} else if field.AutoPathName {
+			field.PathName = c.PathNames.name(field.Name[strings.LastIndex(field.Name, ".")+1:])
 		}
+		if i := strings.LastIndex(field.Name, "."); i != -1 {
+			// Within an inline field, so stored in a directory named by
+			// each of the inline fields containing it.
+			if field.Tag.Entries {
+				return nil, errors.Errorf("%s.%s has entries option; must not be within an inline field",
+					n.Type, field.Name)
+			}
+			var dirs []string
+			for _, name := range strings.Split(field.Name[:i], ".") {
+				dirs = append(dirs, c.PathNames.name(name))
+			}
+			field.PathName = path.Join(append(dirs, field.PathName)...)
+		}
+		if other, ok := pathNames[field.PathName]; ok {
+			return nil, errors.Errorf("fields %s.%s and %s.%s both have path name %q",
+				n.Type, other, n.Type, field.Name, field.PathName)
+		}
+		pathNames[field.PathName] = field.Name
 		childNodeID, err := NewNodeID(n.Type, field.Type, field.Name)
 		if err != nil {
 			return nil, errors.Wrapf(err, "getting ID for %T.%s", n.Type, field.Name)
@@ -49,9 +172,79 @@ func (c *Codec) NewStructNode(base NodeBase) (Node, error) {
 			n.Children[field.Name] = child
 		}
 	}
+	if entries != "" {
+		if err := n.excludeFromEntries(entries, pathNames); err != nil {
+			return nil, err
+		}
+		// Other structs are stored in their directories, alongside their
+		// entries, if they are tagged as dirs and have an entries field.
+		if !n.HasKey && n.Field != nil {
+			n.InDir = n.Field.Tag.IsDir
+		}
+	}
+	n.fileType = n.makeFileType()
 	return n, nil
 }
 
+// excludeFromEntries excludes the first segment of each of pathNames from the
+// elements of the entries field named entries.
+func (n *StructNode) excludeFromEntries(entries string, pathNames map[string]string) error {
+	var dir *DirNodeBase
+	switch entriesNode := (*n.Children[entries]).(type) {
+	default:
+		return errors.Errorf("%s.%s has entries option; must be a map or slice", n.Type, entries)
+	case *MapNode:
+		dir = entriesNode.DirNodeBase
+	case *SliceNode:
+		dir = entriesNode.DirNodeBase
+	}
+	dir.Exclude = map[string]bool{}
+	for pathName, fieldName := range pathNames {
+		if fieldName == entries {
+			continue
+		}
+		if i := strings.Index(pathName, "/"); i != -1 {
+			pathName = pathName[:i]
+		}
+		dir.Exclude[pathName] = true
+	}
+	return nil
+}
+
+// makeFileType returns a struct type with a field for each of n.Fields tagged
+// with its file name, or nil if all fields have the same name and type in the
+// file. If values may be spilled, it also has a field for the spill field.
+func (n *StructNode) makeFileType() reflect.Type {
+	renamed := len(n.inline) != 0 || n.spillSize != 0
+	for name, fileName := range n.FieldNames {
+		renamed = renamed || name != fileName
+	}
+	if !renamed {
+		return nil
+	}
+	fields := make([]reflect.StructField, 0, len(n.Fields))
+	for name, t := range n.Fields {
+		fields = append(fields, reflect.StructField{
+			Name: name,
+			Type: t,
+			Tag:  reflect.StructTag(fmt.Sprintf(`json:%q`, n.FieldNames[name])),
+		})
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Name < fields[j].Name })
+	if n.spillSize != 0 {
+		n.spillFieldName = "Spilled"
+		for n.Fields[n.spillFieldName] != nil {
+			n.spillFieldName += "_"
+		}
+		fields = append(fields, reflect.StructField{
+			Name: n.spillFieldName,
+			Type: reflect.TypeOf([]string{}),
+			Tag:  reflect.StructTag(fmt.Sprintf(`json:%q`, n.spillField)),
+		})
+	}
+	return reflect.StructOf(fields)
+}
+
 // ChildPathName returns the path segment for this node's children.
 func (n *StructNode) ChildPathName(child Node, key, val reflect.Value) string {
 	name, _ := child.FixedPathName()
@@ -61,7 +254,7 @@ func (n *StructNode) ChildPathName(child Node, key, val reflect.Value) string {
 // ReadTargets reads targets into struct fields.
 func (n *StructNode) ReadTargets(c ReadContext, key reflect.Value) (reflect.Value, error) {
 	val := reflect.New(n.Type)
-	if err := c.Read(val.Interface()); err != nil {
+	if err := n.readFileData(c, val.Elem()); err != nil {
 		return val, errors.Wrapf(err, "reading struct fields")
 	}
 	val = val.Elem()
@@ -69,30 +262,58 @@ func (n *StructNode) ReadTargets(c ReadContext, key reflect.Value) (reflect.Valu
 		child := *childPtr
 		childPathName := child.PathName(reflect.Value{}, reflect.Value{})
 		childContext := c.Push(childPathName)
-		if !childContext.Exists() {
+		if in, ok := child.(*InterfaceNode); ok {
+			if !in.Exists(childContext) {
+				continue
+			}
+		} else if !childContext.Exists() {
 			continue
 		}
 		childVal, err := child.Read(childContext, reflect.Value{})
 		if err != nil {
 			return val, errors.Wrapf(err, "reading child %s", fieldName)
 		}
-		val.FieldByName(fieldName).Set(childVal)
+		setFieldByIndex(val, n.index[fieldName]).Set(childVal)
 	}
 	return val, nil
 }
 
-// WriteTargets generates file targets.
+// WriteTargets generates file targets. Every struct has a file of its own,
+// even if it has no untagged fields, so that elements keep their keys.
 func (n *StructNode) WriteTargets(c WriteContext, key, val reflect.Value) error {
-	if err := c.SetValue(n.prepareFileData(val)); err != nil {
-		return errors.Wrap(err, "writing self")
+	return n.writeTargets(c, val, nil)
+}
+
+// writeTargets writes val and its children, adding extra to the data in its
+// file.
+func (n *StructNode) writeTargets(c WriteContext, val reflect.Value, extra map[string]interface{}) error {
+	setValue := c.SetValue
+	if n.InDir {
+		setValue = c.SetDirValue
+	}
+	data := n.prepareFileData(val, extra)
+	if err := n.spill(c, data); err != nil {
+		return err
 	}
 	if !val.IsValid() {
-		return nil
+		return errors.Wrap(setValue(data), "writing self")
 	}
+	if err := n.writeChildren(c, val); err != nil {
+		return err
+	}
+	return errors.Wrap(setValue(data), "writing self")
+}
+
+// writeChildren writes the children of this struct.
+func (n *StructNode) writeChildren(c WriteContext, val reflect.Value) error {
 	for name, childPtr := range n.Children {
 		childNode := *childPtr
 		childKey := reflect.ValueOf(name)
-		childVal := val.FieldByName(name)
+		childVal := fieldByIndex(val, n.index[name])
+		if !childVal.IsValid() {
+			// Promoted from a nil embedded pointer.
+			continue
+		}
 		childContext := c.Push(childNode.PathName(childKey, childVal))
 		if err := childNode.Write(childContext, childKey, childVal); err != nil {
 			return errors.Wrapf(err, "failed to write child %s", name)
@@ -101,13 +322,127 @@ func (n *StructNode) WriteTargets(c WriteContext, key, val reflect.Value) error
 	return nil
 }
 
-func (n *StructNode) prepareFileData(val reflect.Value) interface{} {
+// prepareFileData returns the data to store in this struct's file for val,
+// including extra, or nil if val is not valid.
+func (n *StructNode) prepareFileData(val reflect.Value, extra map[string]interface{}) map[string]interface{} {
 	if !val.IsValid() {
 		return nil
 	}
-	out := make(map[string]interface{}, len(n.Fields))
+	out := make(map[string]interface{}, len(n.Fields)+len(extra))
+	for name, v := range extra {
+		out[name] = v
+	}
 	for name := range n.Fields {
-		out[name] = val.FieldByName(name).Interface()
+		if name == n.ElidedField {
+			continue
+		}
+		v := fieldByIndex(val, n.index[name])
+		if !v.IsValid() {
+			// Promoted from a nil embedded pointer.
+			continue
+		}
+		if it := n.inline[name]; it != nil {
+			v = it.ToFile(v)
+		}
+		out[n.FieldNames[name]] = v.Interface()
 	}
 	return out
 }
+
+// spill writes the values in data which are larger than the spill size to
+// their own files, replacing them in data with a list of their names in the
+// spill field.
+func (n *StructNode) spill(c WriteContext, data map[string]interface{}) error {
+	if n.spillSize == 0 || data == nil {
+		return nil
+	}
+	var spilled []string
+	for name, spillPath := range n.spillPaths {
+		fileName := n.FieldNames[name]
+		v, ok := data[fileName]
+		if !ok {
+			continue
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return errors.Wrapf(err, "measuring field %s", name)
+		}
+		if len(b) <= n.spillSize {
+			continue
+		}
+		if err := c.Push(spillPath).SetValue(v); err != nil {
+			return errors.Wrapf(err, "spilling field %s", name)
+		}
+		delete(data, fileName)
+		spilled = append(spilled, fileName)
+	}
+	if len(spilled) != 0 {
+		sort.Strings(spilled)
+		data[n.spillField] = spilled
+	}
+	return nil
+}
+
+// readSpilled reads the values of fields listed in the spill field of
+// fileVal from their own files into fileVal.
+func (n *StructNode) readSpilled(c ReadContext, fileVal reflect.Value) error {
+	if n.spillSize == 0 {
+		return nil
+	}
+	byFileName := make(map[string]string, len(n.FieldNames))
+	for name, fileName := range n.FieldNames {
+		byFileName[fileName] = name
+	}
+	spilled := fileVal.FieldByName(n.spillFieldName).Interface().([]string)
+	for _, fileName := range spilled {
+		name, ok := byFileName[fileName]
+		if !ok || n.spillPaths[name] == "" {
+			return errors.Errorf("spilled field %q unknown", fileName)
+		}
+		spillContext := c.Push(n.spillPaths[name])
+		if !spillContext.IsFile() {
+			return errors.Errorf("spilled field %s has no file %q", name, spillContext.Path())
+		}
+		v := fileVal.FieldByName(name)
+		if err := spillContext.Read(v.Addr().Interface()); err != nil {
+			return errors.Wrapf(err, "reading spilled field %s", name)
+		}
+	}
+	return nil
+}
+
+// readFileData reads this struct's file into the fields of val.
+func (n *StructNode) readFileData(c ReadContext, val reflect.Value) error {
+	read := c.Read
+	if n.InDir {
+		read = c.ReadDir
+	}
+	if n.fileType == nil {
+		return read(val.Addr().Interface())
+	}
+	fileVal := reflect.New(n.fileType).Elem()
+	if err := read(fileVal.Addr().Interface()); err != nil {
+		return err
+	}
+	if err := n.readSpilled(c, fileVal); err != nil {
+		return err
+	}
+	n.setFields(val, fileVal)
+	return nil
+}
+
+// setFields sets the fields of val from fileVal, a value of fileType.
+func (n *StructNode) setFields(val, fileVal reflect.Value) {
+	for name := range n.Fields {
+		// Zero values are skipped so that embedded pointers are only
+		// allocated for fields present in the file.
+		v := fileVal.FieldByName(name)
+		if v.IsZero() {
+			continue
+		}
+		if it := n.inline[name]; it != nil {
+			v = it.FromFile(v)
+		}
+		setFieldByIndex(val, n.index[name]).Set(v)
+	}
+}
@@ -1,6 +1,7 @@
 package hy
 
 import (
+	"strconv"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -14,22 +15,101 @@ type Tag struct {
 	PathName,
 	Key,
 	SetKey string
+	// KeepKey indicates that the key field of map or slice elements should be
+	// written to element files, rather than being elided.
+	KeepKey bool
+	// KeyOrder lists the fields of a struct map key in the order they appear
+	// as path segments, separated by "/". If empty, the fields appear in the
+	// order they are declared.
+	KeyOrder string
+	// NestedKeys indicates that "/" in string map keys separates directories.
+	NestedKeys bool
+	// ElemDirs indicates that each struct element of a map or slice is stored
+	// in its own directory, with its file inside that directory.
+	ElemDirs bool
+	// Entries indicates that the elements of this map or slice are stored
+	// directly in the directory of the struct containing it.
+	Entries bool
+	// Depth is the number of levels of nested maps and slices stored in
+	// directories, counting this field. Deeper levels are stored in files.
+	// If zero, all levels are stored in directories.
+	Depth int
+	// TypeSuffix indicates that the registered name of the concrete type of
+	// an interface field or element is stored as a suffix of its file or
+	// directory name, rather than in a type field in its file.
+	TypeSuffix bool
+	// Marker indicates that a bool field, or each member of a set stored in
+	// a directory, is stored as the presence of an empty marker file.
+	Marker bool
+	// Gaps is the policy for missing indices when reading a slice stored in a
+	// directory: GapsCompact, GapsZero or GapsError. If empty, it is
+	// GapsCompact.
+	Gaps string
+	// MaxGap is the largest number of missing elements read as zero values
+	// with GapsZero. If zero, it is DefaultMaxGap.
+	MaxGap int
+	// PadIndices indicates that the file names of slice and array elements
+	// are index numbers zero-padded to the width of the largest index, so
+	// that they sort in index order.
+	PadIndices bool
+	// Pairs indicates that the elements of a slice are key/value pairs,
+	// structs with fields Key and Value, stored like the elements of a map
+	// with the order of keys in an order file.
+	Pairs bool
+	// Shard is the length of the name of the shard directory each element
+	// of a map is stored in, within the map's directory. If zero, elements
+	// are not sharded.
+	Shard int
+	// ShardHash indicates that shard directories are named by the start of
+	// the hex SHA-1 hash of each key, rather than the start of the key.
+	ShardHash bool
+	// Chunk is the number of elements of a slice stored in each chunk file
+	// in the slice's directory. If zero, each element has its own file.
+	Chunk int
 }
 
+// Policies for missing slice indices on read.
+const (
+	// GapsCompact reads the elements present in index order, without gaps.
+	GapsCompact = "compact"
+	// GapsZero reads missing elements as zero values.
+	GapsZero = "zero"
+	// GapsError returns an error if any index is missing.
+	GapsError = "error"
+)
+
+// DefaultMaxGap is the largest number of missing elements read as zero values
+// with GapsZero, unless the maxgap option says otherwise. It stops a file with
+// a huge index from allocating a huge slice.
+const DefaultMaxGap = 10000
+
 func parseTag(tagString string) (Tag, error) {
 	if tagString == "" {
 		return Tag{None: true}, nil
 	}
-	var pathName, key, setKey string
-	parts := strings.Split(tagString, ",")
+	var tag Tag
+	var parts []string
+	for i, part := range strings.Split(tagString, ",") {
+		if i != 0 {
+			isOption, err := tag.parseOption(part)
+			if err != nil {
+				return Tag{}, errors.Wrapf(err, "option %q invalid", part)
+			}
+			if isOption {
+				continue
+			}
+		}
+		parts = append(parts, part)
+	}
+	var pathName string
 	if len(parts) > 0 {
 		pathName = parts[0]
 	}
 	if len(parts) > 1 {
-		key = parts[1]
+		tag.Key = parts[1]
 	}
 	if len(parts) > 2 {
-		setKey = parts[2]
+		tag.SetKey = parts[2]
 	}
 	if len(parts) > 3 {
 		return Tag{}, errors.Errorf("malformed tag, too many commas")
@@ -41,12 +121,99 @@ func parseTag(tagString string) (Tag, error) {
 	if err != nil {
 		return Tag{}, errors.Wrapf(err, "path name %q invalid", pathName)
 	}
-	return Tag{
-		IsDir:    isDir,
-		PathName: pathName,
-		Key:      key,
-		SetKey:   setKey,
-	}, nil
+	if tag.Entries && pathName != "." {
+		return Tag{}, errors.Errorf("entries must not have a path name")
+	}
+	if tag.ShardHash && tag.Shard == 0 {
+		return Tag{}, errors.Errorf("shardhash needs the shard option")
+	}
+	tag.PathName = pathName
+	tag.IsDir = isDir || tag.Entries
+	return tag, nil
+}
+
+// parseOption sets the option named by opt on tag. It returns false if opt is
+// not an option, in which case it is a positional part of the tag. Options
+// may appear anywhere after the path name.
+func (tag *Tag) parseOption(opt string) (bool, error) {
+	name, value := opt, ""
+	i := strings.Index(opt, "=")
+	hasValue := i != -1
+	if hasValue {
+		name, value = opt[:i], opt[i+1:]
+	}
+	switch name {
+	default:
+		if hasValue {
+			return false, errors.Errorf("unknown option %q", name)
+		}
+		return false, nil
+	case "keepkey":
+		tag.KeepKey = true
+	case "nestedkeys":
+		tag.NestedKeys = true
+	case "elemdirs":
+		tag.ElemDirs = true
+	case "entries":
+		tag.Entries = true
+	case "typesuffix":
+		tag.TypeSuffix = true
+	case "marker":
+		tag.Marker = true
+	case "pad":
+		tag.PadIndices = true
+	case "pairs":
+		tag.Pairs = true
+	case "shardhash":
+		tag.ShardHash = true
+	case "depth":
+		depth, err := strconv.Atoi(value)
+		if err != nil || depth < 1 {
+			return false, errors.Errorf("option %q must be a positive integer", name)
+		}
+		tag.Depth = depth
+		return true, nil
+	case "chunk":
+		chunk, err := strconv.Atoi(value)
+		if err != nil || chunk < 1 {
+			return false, errors.Errorf("option %q must be a positive integer", name)
+		}
+		tag.Chunk = chunk
+		return true, nil
+	case "maxgap":
+		maxGap, err := strconv.Atoi(value)
+		if err != nil || maxGap < 1 {
+			return false, errors.Errorf("option %q must be a positive integer", name)
+		}
+		tag.MaxGap = maxGap
+		return true, nil
+	case "shard":
+		shard, err := strconv.Atoi(value)
+		if err != nil || shard < 1 || shard > 40 {
+			return false, errors.Errorf("option %q must be an integer from 1 to 40", name)
+		}
+		tag.Shard = shard
+		return true, nil
+	case "gaps":
+		switch value {
+		default:
+			return false, errors.Errorf("option %q must be %q, %q or %q",
+				name, GapsCompact, GapsZero, GapsError)
+		case GapsCompact, GapsZero, GapsError:
+		}
+		tag.Gaps = value
+		return true, nil
+	case "keyorder":
+		if value == "" {
+			return false, errors.Errorf("option %q needs a value", name)
+		}
+		tag.KeyOrder = value
+		return true, nil
+	}
+	if hasValue {
+		return false, errors.Errorf("option %q takes no value", name)
+	}
+	return true, nil
 }
 
 func parsePathName(pathName string) (string, bool, error) {
@@ -33,6 +33,28 @@ var goodTagTable = map[Tag][]string{
 	Tag{PathName: "mypath", IsDir: true, Key: "MyID", SetKey: "SetMyID()"}: {
 		"mypath/,MyID,SetMyID()",
 	},
+	Tag{PathName: "mypath", IsDir: true, Key: "MyID", KeepKey: true}: {
+		"mypath/,MyID,keepkey", "mypath/,keepkey,MyID", "mypath/,MyID,,keepkey",
+	},
+	Tag{PathName: ".", IsDir: true, Key: "Name", Entries: true}: {
+		",Name,entries", "/,Name,entries", ".,entries,Name",
+	},
+	Tag{PathName: "plugins", IsDir: true, TypeSuffix: true}: {
+		"plugins/,typesuffix", "plugins/,,typesuffix",
+	},
+	Tag{PathName: "enabled", Marker: true}: {
+		"enabled,marker",
+	},
+	Tag{PathName: "slice", IsDir: true, Key: "Index", Gaps: GapsZero}: {
+		"slice/,Index,gaps=zero", "slice/,gaps=zero,Index",
+	},
+	Tag{PathName: "slice", IsDir: true, PadIndices: true}:          {"slice/,pad"},
+	Tag{PathName: "slice", IsDir: true, Pairs: true}:               {"slice/,pairs"},
+	Tag{PathName: "slice", IsDir: true, Chunk: 100}:                {"slice/,chunk=100"},
+	Tag{PathName: "slice", IsDir: true, Gaps: GapsZero, MaxGap: 5}: {"slice/,gaps=zero,maxgap=5"},
+	Tag{PathName: "map", IsDir: true, Shard: 2, ShardHash: true}: {
+		"map/,shard=2,shardhash", "map/,shardhash,shard=2",
+	},
 }
 
 func TestParseTag_success(t *testing.T) {
@@ -50,8 +72,17 @@ func TestParseTag_success(t *testing.T) {
 }
 
 var badTagTable = map[string][]string{
-	"malformed tag, too many commas":                     {",,,", "mypath,key,setkey,"},
-	`path name "/mypath" invalid: must not begin with /`: {"/mypath", "/mypath,", "/mypath,,"},
+	"malformed tag, too many commas":                                                 {",,,", "mypath,key,setkey,"},
+	`path name "/mypath" invalid: must not begin with /`:                             {"/mypath", "/mypath,", "/mypath,,"},
+	`option "nosuch=1" invalid: unknown option "nosuch"`:                             {"mypath/,nosuch=1", "mypath/,MyID,nosuch=1"},
+	`option "keepkey=1" invalid: option "keepkey" takes no value`:                    {"mypath/,keepkey=1"},
+	`entries must not have a path name`:                                              {"mypath/,entries"},
+	`option "gaps=none" invalid: option "gaps" must be "compact", "zero" or "error"`: {"mypath/,gaps=none"},
+	`option "gaps" invalid: option "gaps" must be "compact", "zero" or "error"`:      {"mypath/,gaps"},
+	`option "shard=0" invalid: option "shard" must be an integer from 1 to 40`:       {"mypath/,shard=0"},
+	`option "chunk=x" invalid: option "chunk" must be a positive integer`:            {"mypath/,chunk=x"},
+	`option "maxgap=0" invalid: option "maxgap" must be a positive integer`:          {"mypath/,maxgap=0"},
+	`shardhash needs the shard option`:                                               {"mypath/,shardhash"},
 }
 
 func TestParseTag_failure(t *testing.T) {
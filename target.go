@@ -13,3 +13,13 @@ type ReadTarget interface {
 	// Path is the path where this target is stored.
 	Path() string
 }
+
+// DirFilePath returns the path of the file belonging to the directory at dir,
+// which is stored inside that directory. It is dir with a trailing slash, or
+// the empty string (the root file) if dir is the root directory.
+func DirFilePath(dir string) string {
+	if dir == "" {
+		return ""
+	}
+	return dir + "/"
+}
@@ -1,5 +1,12 @@
 package hy
 
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
 var expectedFileTargets FileTargets
 var expectedFileTargetsSnapshot map[string]*FileTarget
 
@@ -12,7 +19,7 @@ func init() {
 				"Int":         1,
 				"InlineSlice": []string{"a", "string", "slice"},
 				"InlineMap":   map[string]int{"one": 1, "two": 2, "three": 3},
-				"StructB":     StructB{},
+				"StructB":     map[string]interface{}{"Name": ""},
 				"StructBPtr":  nil,
 			},
 		},
@@ -30,7 +37,7 @@ func init() {
 				"Int":         2,
 				"InlineMap":   nil,
 				"InlineSlice": nil,
-				"StructB":     StructB{},
+				"StructB":     map[string]interface{}{"Name": ""},
 				"StructBPtr":  nil,
 			},
 		},
@@ -49,7 +56,7 @@ func init() {
 				"Int":         0,
 				"InlineSlice": nil,
 				"InlineMap":   nil,
-				"StructB":     StructB{},
+				"StructB":     map[string]interface{}{"Name": ""},
 				"StructBPtr":  nil,
 			},
 		},
@@ -65,19 +72,17 @@ func init() {
 			Value: nil},
 		{FilePath: "nested/map-of-ptr/this-one-has-a-value",
 			Value: map[string]interface{}{
-				// set automatically
-				"Name": "this-one-has-a-value",
+				// Name elided, it is the key.
 			},
 		},
 		{FilePath: "nested/map/a-zero-file",
 			Value: map[string]interface{}{
-				// set automatically
-				"Name": "a-zero-file",
+				// Name elided, it is the key.
 			},
 		},
 		{FilePath: "nested/map/another-zero-file",
 			Value: map[string]interface{}{
-				"Name": "another-zero-file",
+				// Name elided, it is the key.
 			},
 		},
 		{FilePath: "slice/0",
@@ -92,12 +97,12 @@ func init() {
 		},
 		{FilePath: "map/First",
 			Value: map[string]interface{}{
-				"Name": "First",
+				// Name elided, it is the key.
 			},
 		},
 		{FilePath: "map/Second",
 			Value: map[string]interface{}{
-				"Name": "Second",
+				// Name elided, it is the key.
 			},
 		},
 	}...)
@@ -106,3 +111,49 @@ func init() {
 	}
 	expectedFileTargetsSnapshot = expectedFiles.Snapshot()
 }
+
+// newTestCodec returns a codec reading and writing indented JSON.
+func newTestCodec(configure ...func(*Codec)) *Codec {
+	jsonWriter := JSONWriter
+	jsonWriter.MarshalFunc = func(v interface{}) ([]byte, error) {
+		return json.MarshalIndent(v, "", "  ")
+	}
+	return NewCodec(append([]func(*Codec){func(c *Codec) {
+		c.TreeReader = NewFileTreeReader("json", "_")
+		c.Reader = jsonWriter
+		c.Writer = jsonWriter
+	}}, configure...)...)
+}
+
+// roundTrip writes in to <name> in a new temporary directory and reads it back
+// into out, which must be a pointer. It returns the prefix written to.
+func roundTrip(t *testing.T, c *Codec, name string, in, out interface{}) string {
+	t.Helper()
+	prefix := filepath.Join(t.TempDir(), name)
+	if err := c.Write(prefix, in); err != nil {
+		t.Fatalf("writing: %s", err)
+	}
+	if err := c.Read(prefix, out); err != nil {
+		t.Fatalf("reading: %s", err)
+	}
+	return prefix
+}
+
+// readTestFile returns the contents of the JSON file at path under prefix,
+// with all whitespace removed.
+func readTestFile(t *testing.T, prefix, path string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join(prefix, path+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	b, err = json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
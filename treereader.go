@@ -1,6 +1,7 @@
 package hy
 
 import (
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -8,6 +9,19 @@ import (
 	"github.com/pkg/errors"
 )
 
+// Policies for symlinks found by FileTreeReader.
+const (
+	// SymlinksFollow follows symlinks to files and directories anywhere.
+	SymlinksFollow = "follow"
+	// SymlinksWithinRoot follows symlinks to files and directories within
+	// the tree, and returns an error for symlinks pointing outside it.
+	SymlinksWithinRoot = "within-root"
+	// SymlinksIgnore skips symlinks as if they did not exist.
+	SymlinksIgnore = "ignore"
+	// SymlinksError returns an error for any symlink.
+	SymlinksError = "error"
+)
+
 // FileTreeReader gets targets from the filesystem.
 type FileTreeReader struct {
 	// FileExtension is the extension of files to consider.
@@ -16,6 +30,16 @@ type FileTreeReader struct {
 	Prefix string
 	// RootFileName is the root file name.
 	RootFileName string
+	// Symlinks is the policy for symlinks found in the tree: SymlinksFollow,
+	// SymlinksWithinRoot, SymlinksIgnore or SymlinksError. If empty, it is
+	// SymlinksFollow.
+	Symlinks string
+	// BlobDir and LinkShared should match the options of the same names of
+	// the FileMarshaler which wrote the tree. Symlinks it writes itself, to
+	// blobs in BlobDir, or with LinkShared to other files in the tree, are
+	// then followed whatever the Symlinks policy.
+	BlobDir    string
+	LinkShared bool
 }
 
 // NewFileTreeReader returns a new FileTreeReader configured to consider files
@@ -28,30 +52,140 @@ func NewFileTreeReader(ext, rootFileName string) *FileTreeReader {
 }
 
 // ReadTree reads a tree rooted at prefix and generates a target from each file
-// with extension FileExtension found in the tree.
+// with extension FileExtension found in the tree. Symlinks are handled
+// according to the Symlinks policy. A symlink to a directory containing it is
+// an error, since following it would never end.
 func (ftr *FileTreeReader) ReadTree(prefix string) (FileTargets, error) {
 	ftr.Prefix = prefix
 	targets := MakeFileTargets(0)
-	if err := filepath.Walk(prefix, ftr.MakeWalkFunc(targets)); err != nil {
+	switch ftr.Symlinks {
+	default:
+		return targets, errors.Errorf("symlink policy %q must be %q, %q, %q or %q",
+			ftr.Symlinks, SymlinksFollow, SymlinksWithinRoot, SymlinksIgnore, SymlinksError)
+	case "", SymlinksFollow, SymlinksWithinRoot, SymlinksIgnore, SymlinksError:
+	}
+	root, err := filepath.EvalSymlinks(prefix)
+	if err != nil {
+		return targets, errors.Wrapf(err, "walking tree")
+	}
+	visiting := map[string]bool{root: true}
+	if err := ftr.walk(targets, root, prefix, root, visiting); err != nil {
 		return targets, errors.Wrapf(err, "walking tree")
 	}
 	return targets, nil
 }
 
+// walk adds a target for each file in dir and its subdirectories. realDir is
+// dir with all symlinks resolved, and visiting is the set of resolved
+// directories being walked, including dir.
+func (ftr *FileTreeReader) walk(targets FileTargets, root, dir, realDir string, visiting map[string]bool) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range infos {
+		p := filepath.Join(dir, fi.Name())
+		realPath := filepath.Join(realDir, fi.Name())
+		if fi.Mode()&os.ModeSymlink != 0 {
+			realPath, fi, err = ftr.followSymlink(root, p)
+			if err != nil {
+				return err
+			}
+			if fi == nil {
+				continue
+			}
+		}
+		if !fi.IsDir() {
+			if err := ftr.addFile(targets, p); err != nil {
+				return err
+			}
+			continue
+		}
+		if visiting[realPath] {
+			return errors.Errorf("symlink loop at %q", p)
+		}
+		visiting[realPath] = true
+		err := ftr.walk(targets, root, p, realPath, visiting)
+		delete(visiting, realPath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// followSymlink returns the resolved path of the symlink p and information
+// about the file or directory it points to, or nil information if it should
+// be ignored. Symlinks written by FileMarshaler are followed whatever the
+// policy.
+func (ftr *FileTreeReader) followSymlink(root, p string) (string, os.FileInfo, error) {
+	target, err := filepath.EvalSymlinks(p)
+	var fi os.FileInfo
+	if err == nil {
+		fi, err = os.Stat(target)
+	}
+	within := err == nil && isWithin(root, target)
+	if within && fi.Mode().IsRegular() && ftr.isWrittenLink(root, target) {
+		return target, fi, nil
+	}
+	switch ftr.Symlinks {
+	case SymlinksIgnore:
+		return "", nil, nil
+	case SymlinksError:
+		return "", nil, errors.Errorf("symlink %q not allowed", p)
+	}
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "following symlink %q", p)
+	}
+	if ftr.Symlinks == SymlinksWithinRoot && !within {
+		return "", nil, errors.Errorf("symlink %q points outside %q", p, ftr.Prefix)
+	}
+	return target, fi, nil
+}
+
+// isWrittenLink returns true if target, the resolved path of a symlink to a
+// regular file within root, is one FileMarshaler writes itself: a blob in
+// BlobDir, or with LinkShared, another file with FileExtension.
+func (ftr *FileTreeReader) isWrittenLink(root, target string) bool {
+	if ftr.BlobDir != "" && filepath.Dir(target) == filepath.Join(root, filepath.FromSlash(ftr.BlobDir)) {
+		return isBlobName(filepath.Base(target))
+	}
+	return ftr.LinkShared && filepath.Ext(target) == "."+ftr.FileExtension
+}
+
+// isWithin returns true if p is root or within it.
+func isWithin(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
 // MakeWalkFunc makes a func to process a single filesystem object.
 func (ftr *FileTreeReader) MakeWalkFunc(targets FileTargets) filepath.WalkFunc {
 	return func(p string, fi os.FileInfo, err error) error {
-		if err != nil || fi.IsDir() || filepath.Ext(p) != "."+ftr.FileExtension {
+		if err != nil || fi.IsDir() {
 			return err
 		}
-		path := strings.TrimPrefix(p, ftr.Prefix+"/")
-		path = strings.TrimSuffix(path, "."+ftr.FileExtension)
-		if path == ftr.RootFileName {
-			path = ""
-		}
-		t := &FileTarget{
-			FilePath: path,
-		}
-		return errors.Wrapf(targets.Add(t), "adding file target %q", p)
+		return ftr.addFile(targets, p)
+	}
+}
+
+// addFile adds a target for the file at p, if it has extension FileExtension.
+func (ftr *FileTreeReader) addFile(targets FileTargets, p string) error {
+	if filepath.Ext(p) != "."+ftr.FileExtension {
+		return nil
+	}
+	path, err := filepath.Rel(ftr.Prefix, p)
+	if err != nil {
+		return errors.Wrapf(err, "adding file target %q", p)
+	}
+	path = strings.TrimSuffix(filepath.ToSlash(path), "."+ftr.FileExtension)
+	if path == ftr.RootFileName {
+		path = ""
+	} else if strings.HasSuffix(path, "/"+ftr.RootFileName) {
+		path = DirFilePath(strings.TrimSuffix(path, "/"+ftr.RootFileName))
+	}
+	t := &FileTarget{
+		FilePath: path,
 	}
+	return errors.Wrapf(targets.Add(t), "adding file target %q", p)
 }
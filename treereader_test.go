@@ -1,6 +1,14 @@
 package hy
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
 
 func TestFileTreeReader_ReadTree(t *testing.T) {
 
@@ -18,3 +26,75 @@ func TestFileTreeReader_ReadTree(t *testing.T) {
 	}
 
 }
+
+func TestFileTreeReader_symlinks(t *testing.T) {
+	dir := t.TempDir()
+	prefix := filepath.Join(dir, "symlinks")
+	outside := filepath.Join(dir, "symlinks-outside.json")
+	if err := ioutil.WriteFile(outside, []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		links map[string]string
+		// expected maps policies to the target paths read, or an error.
+		expected map[string]string
+	}{
+		{
+			links: map[string]string{"file.json": "dir/a.json", "linked": "dir"},
+			expected: map[string]string{
+				SymlinksFollow:     "dir/a file linked/a",
+				SymlinksWithinRoot: "dir/a file linked/a",
+				SymlinksIgnore:     "dir/a",
+				SymlinksError:      `error: symlink ` + strconv.Quote(filepath.Join(prefix, "file.json")) + ` not allowed`,
+			},
+		},
+		{
+			links: map[string]string{"outside.json": "../symlinks-outside.json"},
+			expected: map[string]string{
+				SymlinksFollow:     "dir/a outside",
+				SymlinksWithinRoot: `error: symlink ` + strconv.Quote(filepath.Join(prefix, "outside.json")) + ` points outside`,
+				SymlinksIgnore:     "dir/a",
+			},
+		},
+		{
+			links: map[string]string{"dir/loop": ".."},
+			expected: map[string]string{
+				SymlinksFollow:     `error: symlink loop at ` + strconv.Quote(filepath.Join(prefix, "dir/loop")),
+				SymlinksWithinRoot: `error: symlink loop at ` + strconv.Quote(filepath.Join(prefix, "dir/loop")),
+				SymlinksIgnore:     "dir/a",
+			},
+		},
+	} {
+		if err := os.RemoveAll(prefix); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Join(prefix, "dir"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(prefix, "dir/a.json"), []byte(`{}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for link, target := range test.links {
+			if err := os.Symlink(target, filepath.Join(prefix, link)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for policy, expected := range test.expected {
+			tr := NewFileTreeReader("json", "_")
+			tr.Symlinks = policy
+			targets, err := tr.ReadTree(prefix)
+			actual := ""
+			if err != nil {
+				actual = "error: " + err.Error()
+			} else {
+				paths := targets.Paths()
+				sort.Strings(paths)
+				actual = strings.Join(paths, " ")
+			}
+			if isErr := strings.HasPrefix(expected, "error: "); isErr && !strings.Contains(actual,
+				strings.TrimPrefix(expected, "error: ")) || !isErr && actual != expected {
+				t.Errorf("got %q with links %v and policy %q; want %q", actual, test.links, policy, expected)
+			}
+		}
+	}
+}
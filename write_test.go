@@ -51,16 +51,16 @@ var testWriteStructData = TestWriteStruct{
 			"this-one-has-a-value": &StructB{},
 		},
 		Map: map[string]StructB{
-			// Notice how we don't set the Name field here. Hy sets it in the write
-			// data because of the ",Name" tag.
+			// Notice how we don't set the Name field here. Hy elides it from the
+			// written data and sets it on read because of the ",Name" tag.
 			"a-zero-file":       StructB{},
 			"another-zero-file": StructB{},
 		},
 	},
 	Slice: []StructB{{Name: "One"}, {Name: "Two"}},
 	Map: map[string]StructB{
-		// Notice how we don't set the Name field here. Hy sets it in the write
-		// data because of the ",Name" tag.
+		// Notice how we don't set the Name field here. Hy elides it from the
+		// written data and sets it on read because of the ",Name" tag.
 		"First":  StructB{},
 		"Second": StructB{},
 	},
@@ -122,6 +122,34 @@ func TestNode_Write_struct(t *testing.T) {
 	}
 }
 
+func TestNode_Write_keepKey(t *testing.T) {
+	type keepKey struct {
+		Map map[string]StructB `hy:"map/,Name,keepkey"`
+	}
+	c := NewCodec()
+	n, err := c.Analyse(keepKey{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wc := NewWriteContext()
+	v := reflect.ValueOf(keepKey{Map: map[string]StructB{"First": {}}})
+	if err := n.Write(wc, reflect.Value{}, v); err != nil {
+		t.Fatal(err)
+	}
+	target, ok := wc.targets.Snapshot()["map/First"]
+	if !ok {
+		t.Fatalf("missing file %q", "map/First")
+	}
+	expected := `{"Name":"First"}`
+	actual, err := json.Marshal(target.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(actual) != expected {
+		t.Errorf("got %s; want %s", actual, expected)
+	}
+}
+
 func (ft FileTarget) TestDump() string {
 	return fmt.Sprintf("file: %q\n%s\n", ft.FilePath, ft.TestDataDump())
 }
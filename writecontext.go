@@ -43,3 +43,11 @@ func (c WriteContext) SetValue(v interface{}) error {
 	t := &FileTarget{FilePath: c.Path(), Value: v}
 	return errors.Wrapf(c.targets.Add(t), "setting value at %q", c.Path())
 }
+
+// SetDirValue sets the value of the file belonging to the directory at the
+// current path, which is stored inside that directory.
+func (c WriteContext) SetDirValue(v interface{}) error {
+	p := DirFilePath(c.Path())
+	t := &FileTarget{FilePath: p, Value: v}
+	return errors.Wrapf(c.targets.Add(t), "setting value at %q", p)
+}